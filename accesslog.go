@@ -0,0 +1,181 @@
+package stats
+
+// AccessLog writes one structured log line per request, with the request's metrics
+// in it, so that requests and metrics don't have to be joined up later:
+//
+//	router.Use(stats.Metrics(sink))
+//	router.Use(stats.AccessLog(stats.AccessLogPolicy{
+//	    Logger:     slog.New(slog.NewJSONHandler(os.Stdout, nil)),
+//	    Omit:       []string{stats.FieldPath},
+//	    SampleRate: 0.1,
+//	    KeepErrors: true,
+//	}))
+//
+// The line is written when the request's metrics are flushed, so it has the final
+// values of everything, including timers that were finished by the flush. It looks like:
+//
+//	{"time":"...","level":"INFO","msg":"Request","method":"GET","route":"GET /users/{id}",
+//	 "path":"/users/12","status":200,"bytes":1024,"duration_ms":12.5,
+//	 "counters":{"cache/hit":2},"timers":{"db/query":8.25}}
+//
+// Durations are in milliseconds. Counters are Estimates (see sampling.go). When requests
+// are sampled, each line has a sample_rate field, to scale counts of lines back up.
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Access log fields, for AccessLogPolicy.Fields and Omit
+const (
+	FieldMethod     = "method"
+	FieldRoute      = "route"
+	FieldPath       = "path"
+	FieldStatus     = "status"
+	FieldBytes      = "bytes"
+	FieldDuration   = "duration_ms"
+	FieldTraceID    = "trace_id"
+	FieldCounters   = "counters"
+	FieldTimers     = "timers"
+	FieldSampleRate = "sample_rate"
+)
+
+// AccessLogPolicy configures AccessLog. Zero fields get the defaults noted.
+type AccessLogPolicy struct {
+	Logger     *slog.Logger               // Where lines are written (default slog.Default())
+	Level      slog.Level                 // Level of the lines (default Info)
+	Message    string                     // Message of the lines (default "Request")
+	Fields     []string                   // Fields to include (default all of them)
+	Omit       []string                   // Fields to leave out
+	Buckets    func(bucket string) bool   // Counters and timers to include (default all of them)
+	SampleRate float64                    // Fraction of requests to log (default 1)
+	KeepErrors bool                       // Log every response with a 5xx status, regardless of SampleRate
+	Route      func(*http.Request) string // Names the route (default: the ServeMux pattern, or the path)
+}
+
+func (p AccessLogPolicy) withDefaults() AccessLogPolicy {
+	if p.Message == "" {
+		p.Message = "Request"
+	}
+	if p.SampleRate <= 0 || p.SampleRate > 1 {
+		p.SampleRate = 1
+	}
+	if p.Route == nil {
+		p.Route = requestRoute
+	}
+	return p
+}
+
+// fieldSet returns the fields to write
+func (p AccessLogPolicy) fieldSet() map[string]bool {
+	fields := p.Fields
+	if len(fields) == 0 {
+		fields = []string{FieldMethod, FieldRoute, FieldPath, FieldStatus, FieldBytes, FieldDuration,
+			FieldTraceID, FieldCounters, FieldTimers, FieldSampleRate}
+	}
+	set := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		set[f] = true
+	}
+	for _, f := range p.Omit {
+		delete(set, f)
+	}
+	return set
+}
+
+// accessRecord is what's known about a request when its handler returns
+type accessRecord struct {
+	method, route, path, traceID string
+	status                       int
+	bytes                        int64
+	duration                     time.Duration
+	rate                         float64
+}
+
+// AccessLog is middleware that logs each request along with its metrics. It has to
+// come after Metrics to include the request's metrics; without them, lines are written
+// as soon as the handler returns.
+func AccessLog(policy AccessLogPolicy) func(http.Handler) http.Handler {
+	policy = policy.withDefaults()
+	fields := policy.fieldSet()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rw := wrapResponse(w)
+			next.ServeHTTP(rw, r)
+			rw.finish()
+
+			rate := policy.SampleRate
+			if policy.KeepErrors && rw.Status() >= 500 {
+				rate = 1
+			} else if !sampled(rate) {
+				return
+			}
+			record := accessRecord{
+				method:   r.Method,
+				route:    policy.Route(r),
+				path:     r.URL.Path,
+				traceID:  TraceID(r),
+				status:   rw.Status(),
+				bytes:    rw.bytes,
+				duration: time.Since(start),
+				rate:     rate,
+			}
+			// without metrics, or if they've already been flushed, the line is written now
+			registered := onFlush(r.Context(), func(ctx context.Context, s RequestSnapshot) {
+				policy.write(ctx, fields, record, s)
+			})
+			if !registered {
+				policy.write(r.Context(), fields, record, RequestSnapshot{})
+			}
+		})
+	}
+}
+
+func (p AccessLogPolicy) write(ctx context.Context, fields map[string]bool, rec accessRecord, s RequestSnapshot) {
+	attrs := make([]slog.Attr, 0, len(fields))
+	add := func(field string, value slog.Value) {
+		if fields[field] {
+			attrs = append(attrs, slog.Attr{Key: field, Value: value})
+		}
+	}
+	add(FieldMethod, slog.StringValue(rec.method))
+	add(FieldRoute, slog.StringValue(rec.route))
+	add(FieldPath, slog.StringValue(rec.path))
+	add(FieldStatus, slog.IntValue(rec.status))
+	add(FieldBytes, slog.Int64Value(rec.bytes))
+	add(FieldDuration, slog.Float64Value(milliseconds(rec.duration)))
+	if rec.traceID != "" {
+		add(FieldTraceID, slog.StringValue(rec.traceID))
+	}
+	add(FieldCounters, slog.GroupValue(bucketAttrs(p, s.counters, func(n int) slog.Value {
+		return slog.IntValue(n)
+	})...))
+	add(FieldTimers, slog.GroupValue(bucketAttrs(p, s.timers, func(d time.Duration) slog.Value {
+		return slog.Float64Value(milliseconds(d))
+	})...))
+	if rec.rate < 1 {
+		add(FieldSampleRate, slog.Float64Value(rec.rate))
+	}
+	logger := p.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.LogAttrs(ctx, p.Level, p.Message, attrs...)
+}
+
+// bucketAttrs makes an attribute for each of the buckets that pass the Buckets filter,
+// sorted by bucket
+func bucketAttrs[V any](p AccessLogPolicy, values map[string]V, value func(V) slog.Value) []slog.Attr {
+	attrs := make([]slog.Attr, 0, len(values))
+	for bucket, v := range values {
+		if p.Buckets == nil || p.Buckets(bucket) {
+			attrs = append(attrs, slog.Attr{Key: bucket, Value: value(v)})
+		}
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+	return attrs
+}
@@ -0,0 +1,163 @@
+package stats
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// logBuffer collects log lines, which are written from the flush goroutine
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (lb *logBuffer) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *logBuffer) lines() []map[string]any {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(lb.buf.String()), "\n") {
+		var m map[string]any
+		if json.Unmarshal([]byte(line), &m) == nil {
+			lines = append(lines, m)
+		}
+	}
+	return lines
+}
+
+func (lb *logBuffer) waitForLines(t *testing.T, n int) []map[string]any {
+	t.Helper()
+	waitFor(t, func() bool { return len(lb.lines()) >= n })
+	return lb.lines()
+}
+
+func TestAccessLog(t *testing.T) {
+	lb := &logBuffer{}
+	mw := chain(Metrics(nil), AccessLog(AccessLogPolicy{Logger: slog.New(slog.NewJSONHandler(lb, nil))}))
+	r := httptest.NewRequest("GET", "/users/12", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	serveRequest(mw, r, func(w http.ResponseWriter, r *http.Request) {
+		Increment(r.Context(), "cache/hit")
+		StartTimer(r.Context(), "db/query")
+		FinishTimer(r.Context(), "db/query")
+		StartTimer(r.Context(), "render") // finished by the flush
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("not found"))
+	})
+
+	line := lb.waitForLines(t, 1)[0]
+	if line["msg"] != "Request" || line["method"] != "GET" || line["route"] != "/users/12" || line["path"] != "/users/12" {
+		t.Errorf("Unexpected request details %v", line)
+	}
+	if line["status"] != float64(404) || line["bytes"] != float64(9) || line["trace_id"] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Unexpected response details %v", line)
+	}
+	if _, ok := line["duration_ms"]; !ok {
+		t.Errorf("Expected a duration, got %v", line)
+	}
+	if counters, _ := line["counters"].(map[string]any); counters["cache/hit"] != float64(1) {
+		t.Errorf("Expected the request's counters, got %v", line["counters"])
+	}
+	if timers, _ := line["timers"].(map[string]any); len(timers) != 2 {
+		t.Errorf("Expected the request's timers, including the one finished by the flush, got %v", line["timers"])
+	}
+	if _, ok := line["sample_rate"]; ok {
+		t.Errorf("Didn't expect a sample rate when every request is logged")
+	}
+}
+
+func TestAccessLogWithoutMetrics(t *testing.T) {
+	lb := &logBuffer{}
+	mw := AccessLog(AccessLogPolicy{Logger: slog.New(slog.NewJSONHandler(lb, nil))})
+	serve(mw, func(w http.ResponseWriter, r *http.Request) {})
+	if lines := lb.lines(); len(lines) != 1 || lines[0]["status"] != float64(200) {
+		t.Errorf("Expected the line to be written right away, got %v", lines)
+	}
+}
+
+func TestAccessLogAfterFlush(t *testing.T) {
+	lb := &logBuffer{}
+	flushed := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	mw := chain(
+		Metrics(nopSink{}, OnFlush(func(ctx context.Context, s RequestSnapshot) { close(flushed) })),
+		AccessLog(AccessLogPolicy{Logger: slog.New(slog.NewJSONHandler(lb, nil))}),
+	)
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	serveRequest(mw, r, func(w http.ResponseWriter, r *http.Request) {
+		Increment(r.Context(), "test/counter")
+		// the client goes away, and the metrics are flushed before the handler returns
+		cancel()
+		<-flushed
+	})
+	lines := lb.waitForLines(t, 1)
+	if len(lines) != 1 || lines[0]["counters"] != nil {
+		t.Errorf("Expected the line to be written without metrics, got %v", lines)
+	}
+}
+
+func TestAccessLogFields(t *testing.T) {
+	lb := &logBuffer{}
+	mw := chain(Metrics(nil), AccessLog(AccessLogPolicy{
+		Logger:  slog.New(slog.NewJSONHandler(lb, nil)),
+		Fields:  []string{FieldMethod, FieldStatus, FieldPath, FieldCounters},
+		Omit:    []string{FieldPath},
+		Buckets: func(bucket string) bool { return strings.HasPrefix(bucket, "keep/") },
+	}))
+	serve(mw, func(w http.ResponseWriter, r *http.Request) {
+		Increment(r.Context(), "keep/counter")
+		Increment(r.Context(), "drop/counter")
+		StartTimer(r.Context(), "keep/timer")
+		FinishTimer(r.Context(), "keep/timer")
+	})
+
+	line := lb.waitForLines(t, 1)[0]
+	for _, field := range []string{FieldMethod, FieldStatus, FieldCounters} {
+		if _, ok := line[field]; !ok {
+			t.Errorf("Expected field %s in %v", field, line)
+		}
+	}
+	for _, field := range []string{FieldPath, FieldRoute, FieldTimers, FieldDuration} {
+		if _, ok := line[field]; ok {
+			t.Errorf("Didn't expect field %s in %v", field, line)
+		}
+	}
+	if counters, _ := line["counters"].(map[string]any); len(counters) != 1 || counters["keep/counter"] != float64(1) {
+		t.Errorf("Expected only the filtered counters, got %v", line["counters"])
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	lb := &logBuffer{}
+	mw := chain(Metrics(nil), AccessLog(AccessLogPolicy{
+		Logger:     slog.New(slog.NewJSONHandler(lb, nil)),
+		SampleRate: 1e-9,
+		KeepErrors: true,
+	}))
+	for i := 0; i < 10; i++ {
+		serve(mw, func(w http.ResponseWriter, r *http.Request) {})
+	}
+	serve(mw, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	lines := lb.waitForLines(t, 1)
+	if len(lines) != 1 || lines[0]["status"] != float64(502) {
+		t.Fatalf("Expected only the error to be logged, got %v", lines)
+	}
+	if _, ok := lines[0]["sample_rate"]; ok {
+		t.Errorf("Errors that are always kept shouldn't have a sample rate")
+	}
+}
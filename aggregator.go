@@ -0,0 +1,364 @@
+package stats
+
+// The Aggregator rolls metrics up across requests, so that a backend sees one
+// data point per bucket per flush interval instead of one per request.
+//
+// Aggregators are built to be shared by every core on the box. The bucket index
+// is split into shards, each holding a copy-on-write map behind an atomic pointer,
+// so looking up a known bucket takes no locks at all. New buckets go into a small
+// locked map first, which is merged into the copy-on-write map once it's grown to a
+// fraction of its size, so that adding n buckets doesn't copy the map n times.
+// Buckets that see nothing for a few flushes in a row are evicted, so that names that
+// come and go don't accumulate forever. Each bucket's values are in turn striped
+// across several cache-line-padded cells, so concurrent writers to the same hot
+// bucket rarely touch the same memory. Counter cells are atomic; a timer's count and
+// sum have to change together, so its cells are small locked structs instead. The
+// stripes are merged (and reset) when the aggregator is flushed.
+
+import (
+	"context"
+	"github.com/efixler/multierror"
+	"math/rand/v2"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const aggregatorShards = 32 // must be a power of 2
+
+// Aggregator accumulates counters and timers across requests. It implements Sink,
+// so it can be passed to Metrics directly, and it is drained into another Sink with
+// Flush or FlushEvery:
+//
+//	agg := stats.NewAggregator()
+//	go agg.FlushEvery(ctx, stackdriver.Sink, time.Minute)
+//	router.Use(stats.Metrics(agg))
+//
+// Counters are flushed as the sum of all increments since the last flush. Timers
+// are flushed as the mean of all durations since the last flush. Metrics with the
+// same name but different tags are aggregated separately.
+type Aggregator struct {
+	shards  [aggregatorShards]aggregatorShard
+	stripes int
+
+	flushMu         sync.Mutex // one drain at a time
+	retiredCounters []*counterAccumulator
+	retiredTimers   []*timerAccumulator
+}
+
+// Buckets that have been idle for this many flushes in a row are evicted
+const aggregatorIdleFlushes = 2
+
+type aggregatorShard struct {
+	counters bucketIndex[*counterAccumulator]
+	timers   bucketIndex[*timerAccumulator]
+}
+
+// bucketIndex maps series keys to accumulators. Known keys are looked up in a
+// copy-on-write map without locking; new keys are added to dirty, under the lock,
+// and merged into the copy-on-write map in batches.
+type bucketIndex[A any] struct {
+	mu    sync.Mutex
+	read  atomic.Pointer[map[string]A]
+	dirty map[string]A
+}
+
+func (ix *bucketIndex[A]) load() map[string]A {
+	if m := ix.read.Load(); m != nil {
+		return *m
+	}
+	return nil
+}
+
+// get returns the accumulator for key, making it with create if there isn't one
+func (ix *bucketIndex[A]) get(key string, create func() A) A {
+	if acc, ok := ix.load()[key]; ok {
+		return acc
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	read := ix.load()
+	if acc, ok := read[key]; ok {
+		return acc
+	} else if acc, ok := ix.dirty[key]; ok {
+		return acc
+	}
+	acc := create()
+	if ix.dirty == nil {
+		ix.dirty = make(map[string]A)
+	}
+	ix.dirty[key] = acc
+	// merging once dirty is a quarter the size of read keeps the copying to a
+	// constant amount per key
+	if len(ix.dirty) > len(read)/4 {
+		ix.merge(read, nil)
+	}
+	return acc
+}
+
+// merge the dirty keys into the copy-on-write map, leaving out the evicted ones.
+// ix.mu must be held.
+func (ix *bucketIndex[A]) merge(read map[string]A, evicted map[string]bool) {
+	next := make(map[string]A, len(read)+len(ix.dirty)-len(evicted))
+	for k, v := range read {
+		if !evicted[k] {
+			next[k] = v
+		}
+	}
+	for k, v := range ix.dirty {
+		if !evicted[k] {
+			next[k] = v
+		}
+	}
+	ix.read.Store(&next)
+	ix.dirty = nil
+}
+
+// all returns every accumulator in the index
+func (ix *bucketIndex[A]) all() map[string]A {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if len(ix.dirty) > 0 {
+		ix.merge(ix.load(), nil)
+	}
+	return ix.load()
+}
+
+// evict removes the keys from the index
+func (ix *bucketIndex[A]) evict(keys map[string]bool) {
+	if len(keys) == 0 {
+		return
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.merge(ix.load(), keys)
+}
+
+// cell is an atomic value padded out to its own cache line
+type cell struct {
+	atomic.Int64
+	_ [56]byte
+}
+
+type counterAccumulator struct {
+	name    string
+	tags    Tags
+	stripes []cell
+	idle    int // flushes in a row that found nothing; only touched by drain
+}
+
+// take the counter's total, resetting it
+func (acc *counterAccumulator) take() int64 {
+	var sum int64
+	for i := range acc.stripes {
+		sum += acc.stripes[i].Swap(0)
+	}
+	return sum
+}
+
+// timerCell is a stripe of a timer, padded out to its own cache line. The count and
+// sum are locked together, so that a flush never sees a duration without its count.
+type timerCell struct {
+	mu    sync.Mutex
+	count int64
+	sum   int64
+	_     [40]byte
+}
+
+type timerAccumulator struct {
+	name    string
+	tags    Tags
+	stripes []timerCell
+	idle    int
+}
+
+func (c *timerCell) add(count, sum int64) {
+	c.mu.Lock()
+	c.count += count
+	c.sum += sum
+	c.mu.Unlock()
+}
+
+// take the timer's count and sum, resetting them
+func (acc *timerAccumulator) take() (int64, int64) {
+	var count, sum int64
+	for i := range acc.stripes {
+		c := &acc.stripes[i]
+		c.mu.Lock()
+		count, sum = count+c.count, sum+c.sum
+		c.count, c.sum = 0, 0
+		c.mu.Unlock()
+	}
+	return count, sum
+}
+
+// NewAggregator makes an Aggregator with stripes sized for the current GOMAXPROCS.
+func NewAggregator() *Aggregator {
+	stripes := 1
+	for stripes < runtime.GOMAXPROCS(0) {
+		stripes <<= 1
+	}
+	return &Aggregator{stripes: stripes}
+}
+
+// AddCounter adds n to the named counter.
+func (a *Aggregator) AddCounter(name string, n int64) {
+	a.addCounter(name, nil, n)
+}
+
+// AddTimer records one duration for the named timer.
+func (a *Aggregator) AddTimer(name string, d time.Duration) {
+	a.addTimer(name, nil, d)
+}
+
+func (a *Aggregator) addCounter(name string, tags Tags, n int64) {
+	if n == 0 {
+		return
+	}
+	c := a.counter(name, tags)
+	c.stripes[a.stripe()].Add(n)
+}
+
+func (a *Aggregator) addTimer(name string, tags Tags, d time.Duration) {
+	a.timer(name, tags).stripes[a.stripe()].add(1, int64(d))
+}
+
+// WriteCounters implements Sink. Sampled counters are added as their estimates, so
+// the aggregated counters aren't sampled.
+func (a *Aggregator) WriteCounters(ctx context.Context, counters ...*Counter) error {
+	for _, c := range counters {
+		a.addCounter(c.Name(), c.Tags(), int64(c.Estimate()))
+	}
+	return nil
+}
+
+// WriteTimers implements Sink.
+func (a *Aggregator) WriteTimers(ctx context.Context, timers ...*Timer) error {
+	for _, t := range timers {
+		a.addTimer(t.Name(), t.Tags(), time.Duration(t.Duration()))
+	}
+	return nil
+}
+
+// Flush merges everything accumulated since the last flush and writes it to sink.
+// Buckets that saw no activity aren't written. Values accumulated while a flush is
+// in progress will be picked up by either this flush or the next one. If sink is a
+// Flusher, it's flushed after the write.
+func (a *Aggregator) Flush(ctx context.Context, sink Sink) error {
+	sink = withNameTranslation(sink)
+	counters, timers := a.drain()
+	me := make(multierror.MultiError, 0)
+	if len(counters) > 0 {
+		if err := sink.WriteCounters(ctx, counters...); err != nil {
+			me = append(me, err)
+		}
+	}
+	if len(timers) > 0 {
+		if err := sink.WriteTimers(ctx, timers...); err != nil {
+			me = append(me, err)
+		}
+	}
+	if err := FlushSink(ctx, sink); err != nil {
+		me = append(me, err)
+	}
+	return me.NilWhenEmpty()
+}
+
+// FlushEvery flushes the aggregator to sink on the given interval until ctx is
+// done, then flushes one last time. Flush errors are logged.
+func (a *Aggregator) FlushEvery(ctx context.Context, sink Sink, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := a.Flush(ctx, sink); err != nil {
+				reportError(ctx, err, "Error flushing aggregated metrics")
+			}
+		case <-ctx.Done():
+			// ctx is done, so the final flush needs one of its own
+			if err := a.Flush(context.Background(), sink); err != nil {
+				reportError(ctx, err, "Error flushing aggregated metrics")
+			}
+			return
+		}
+	}
+}
+
+// drain takes everything accumulated since the last drain, and evicts the buckets
+// that have been idle for too long
+func (a *Aggregator) drain() ([]*Counter, []*Timer) {
+	a.flushMu.Lock()
+	defer a.flushMu.Unlock()
+	// a writer that looked up a bucket just before it was evicted may have added to
+	// it since, so whatever's there goes to the bucket's replacement
+	for _, acc := range a.retiredCounters {
+		if sum := acc.take(); sum != 0 {
+			a.addCounter(acc.name, acc.tags, sum)
+		}
+	}
+	for _, acc := range a.retiredTimers {
+		if count, sum := acc.take(); count != 0 {
+			a.timer(acc.name, acc.tags).stripes[0].add(count, sum)
+		}
+	}
+	a.retiredCounters, a.retiredTimers = nil, nil
+
+	counters := make([]*Counter, 0)
+	timers := make([]*Timer, 0)
+	for i := range a.shards {
+		shard := &a.shards[i]
+		idle := make(map[string]bool)
+		for key, acc := range shard.counters.all() {
+			if sum := acc.take(); sum != 0 {
+				acc.idle = 0
+				counters = append(counters, &Counter{metric: metric{name: acc.name, data: int(sum), tags: acc.tags}})
+			} else if acc.idle++; acc.idle >= aggregatorIdleFlushes {
+				idle[key] = true
+				a.retiredCounters = append(a.retiredCounters, acc)
+			}
+		}
+		shard.counters.evict(idle)
+		idle = make(map[string]bool)
+		for key, acc := range shard.timers.all() {
+			if count, sum := acc.take(); count != 0 {
+				acc.idle = 0
+				timers = append(timers, &Timer{metric: metric{name: acc.name, data: int(sum / count), tags: acc.tags}})
+			} else if acc.idle++; acc.idle >= aggregatorIdleFlushes {
+				idle[key] = true
+				a.retiredTimers = append(a.retiredTimers, acc)
+			}
+		}
+		shard.timers.evict(idle)
+	}
+	return counters, timers
+}
+
+func (a *Aggregator) stripe() int {
+	return int(rand.Uint32()) & (a.stripes - 1)
+}
+
+// shard picks the key's shard with an inlined FNV-1a, since hash/fnv would allocate
+func (a *Aggregator) shard(key string) *aggregatorShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &a.shards[h&(aggregatorShards-1)]
+}
+
+func (a *Aggregator) counter(name string, tags Tags) *counterAccumulator {
+	key := seriesKey(name, tags)
+	return a.shard(key).counters.get(key, func() *counterAccumulator {
+		return &counterAccumulator{name: name, tags: tags, stripes: make([]cell, a.stripes)}
+	})
+}
+
+func (a *Aggregator) timer(name string, tags Tags) *timerAccumulator {
+	key := seriesKey(name, tags)
+	return a.shard(key).timers.get(key, func() *timerAccumulator {
+		return &timerAccumulator{name: name, tags: tags, stripes: make([]timerCell, a.stripes)}
+	})
+}
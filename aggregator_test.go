@@ -0,0 +1,219 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingSink struct {
+	mu       sync.Mutex
+	counters []*Counter
+	timers   []*Timer
+}
+
+func (rs *recordingSink) WriteCounters(ctx context.Context, counters ...*Counter) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.counters = append(rs.counters, counters...)
+	return nil
+}
+
+func (rs *recordingSink) WriteTimers(ctx context.Context, timers ...*Timer) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.timers = append(rs.timers, timers...)
+	return nil
+}
+
+func TestAggregator(t *testing.T) {
+	agg := NewAggregator()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				agg.AddCounter("test/counter", 1)
+				agg.AddTimer("test/timer", time.Duration(j%2+1)*time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+	sink := &recordingSink{}
+	if err := agg.Flush(context.Background(), sink); err != nil {
+		t.Fatalf("Unexpected flush error: %s", err)
+	}
+	if len(sink.counters) != 1 || sink.counters[0].Data() != 8000 {
+		t.Errorf("Expected one counter with 8000, got %v", sink.counters)
+	}
+	if len(sink.timers) != 1 || sink.timers[0].Duration() != int64(1500*time.Microsecond) {
+		t.Errorf("Expected one timer averaging 1.5ms, got %v", sink.timers)
+	}
+	sink = &recordingSink{}
+	agg.Flush(context.Background(), sink)
+	if len(sink.counters) != 0 || len(sink.timers) != 0 {
+		t.Errorf("Second flush should be empty, got %d counters and %d timers", len(sink.counters), len(sink.timers))
+	}
+}
+
+func TestAggregatorTimerFlushDuringWrites(t *testing.T) {
+	agg := NewAggregator()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					agg.AddTimer("test/timer", time.Millisecond)
+				}
+			}
+		}()
+	}
+	sink := &recordingSink{}
+	for deadline := time.Now().Add(50 * time.Millisecond); time.Now().Before(deadline); {
+		agg.Flush(context.Background(), sink)
+	}
+	close(done)
+	wg.Wait()
+	agg.Flush(context.Background(), sink)
+	for _, timer := range sink.timers {
+		// every duration is the same, so a flush that split a count from its sum
+		// would show up as a different mean
+		if timer.Duration() != int64(time.Millisecond) {
+			t.Fatalf("Expected every flushed mean to be 1ms, got %v", time.Duration(timer.Duration()))
+		}
+	}
+}
+
+func TestAggregatorEviction(t *testing.T) {
+	agg := NewAggregator()
+	agg.AddCounter("test/counter", 1)
+	agg.AddTimer("test/timer", time.Millisecond)
+	index := func() int {
+		n := 0
+		for i := range agg.shards {
+			n += len(agg.shards[i].counters.all()) + len(agg.shards[i].timers.all())
+		}
+		return n
+	}
+	for i := 0; i < aggregatorIdleFlushes; i++ {
+		agg.Flush(context.Background(), &recordingSink{})
+	}
+	if n := index(); n != 2 {
+		t.Fatalf("Buckets shouldn't be evicted before they've been idle long enough, have %d", n)
+	}
+	counter := agg.counter("test/counter", nil)
+	agg.Flush(context.Background(), &recordingSink{})
+	if n := index(); n != 0 {
+		t.Fatalf("Expected idle buckets to be evicted, have %d", n)
+	}
+
+	// a writer still holding the evicted bucket doesn't lose its count
+	counter.stripes[0].Add(3)
+	sink := &recordingSink{}
+	agg.Flush(context.Background(), sink)
+	if len(sink.counters) != 1 || sink.counters[0].Data() != 3 {
+		t.Errorf("Expected the late count to be flushed, got %v", sink.counters)
+	}
+}
+
+func TestAggregatorManyBuckets(t *testing.T) {
+	agg := NewAggregator()
+	for i := 0; i < 5000; i++ {
+		agg.AddCounter(fmt.Sprintf("test/counter_%d", i), 1)
+	}
+	sink := &recordingSink{}
+	agg.Flush(context.Background(), sink)
+	if len(sink.counters) != 5000 {
+		t.Errorf("Expected 5000 counters, got %d", len(sink.counters))
+	}
+}
+
+// mutexAggregator is the single-lock design that the Aggregator is benchmarked against
+type mutexAggregator struct {
+	mu       sync.Mutex
+	counters map[string]int64
+}
+
+func (m *mutexAggregator) AddCounter(name string, n int64) {
+	m.mu.Lock()
+	m.counters[name] += n
+	m.mu.Unlock()
+}
+
+const contentionGoroutines = 64 // per GOMAXPROCS
+
+func BenchmarkAggregatorHotCounter(b *testing.B) {
+	agg := NewAggregator()
+	b.ReportAllocs()
+	b.SetParallelism(contentionGoroutines)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			agg.AddCounter("bench/counter", 1)
+		}
+	})
+}
+
+func BenchmarkMutexHotCounter(b *testing.B) {
+	agg := &mutexAggregator{counters: make(map[string]int64)}
+	b.ReportAllocs()
+	b.SetParallelism(contentionGoroutines)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			agg.AddCounter("bench/counter", 1)
+		}
+	})
+}
+
+var benchNames = func() []string {
+	names := make([]string, 64)
+	for i := range names {
+		names[i] = fmt.Sprintf("bench/counter_%d", i)
+	}
+	return names
+}()
+
+func BenchmarkAggregatorManyCounters(b *testing.B) {
+	agg := NewAggregator()
+	b.ReportAllocs()
+	b.SetParallelism(contentionGoroutines)
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			agg.AddCounter(benchNames[i&63], 1)
+			i++
+		}
+	})
+}
+
+func BenchmarkMutexManyCounters(b *testing.B) {
+	agg := &mutexAggregator{counters: make(map[string]int64)}
+	b.ReportAllocs()
+	b.SetParallelism(contentionGoroutines)
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			agg.AddCounter(benchNames[i&63], 1)
+			i++
+		}
+	})
+}
+
+func BenchmarkAggregatorHotTimer(b *testing.B) {
+	agg := NewAggregator()
+	b.ReportAllocs()
+	b.SetParallelism(contentionGoroutines)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			agg.AddTimer("bench/timer", time.Millisecond)
+		}
+	})
+}
@@ -0,0 +1,144 @@
+package stats
+
+// Aliases keep dashboards working while a metric is renamed. For the duration of an
+// alias, the metric is written under both its new name and its old one, no matter
+// which name it was recorded under. Once the alias expires only the new name is
+// written, though code still recording the old name is still redirected to the new one.
+//
+// Every use of a deprecated name is counted (see Aliases.Uses) and logged, at most
+// once a minute per name, so that remaining callers can be tracked down.
+//
+//	aliases, _ := stats.NewAliases(stats.Alias{
+//	    Old:   "user_signup",
+//	    New:   "users/signup",
+//	    Until: releaseDate.AddDate(0, 3, 0), // give dashboards a quarter to move
+//	})
+//	router.Use(stats.Metrics(stats.WithAliases(stackdriver.Sink, aliases)))
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var AliasConflict = errors.New("Metric name is already part of an alias")
+
+const deprecationLogInterval = time.Minute
+
+// Alias is the renaming of a metric from Old to New. Both names are written until
+// Until; a zero Until means both names are written indefinitely.
+type Alias struct {
+	Old   string
+	New   string
+	Until time.Time
+}
+
+func (a Alias) dualWrite(now time.Time) bool {
+	return a.Until.IsZero() || now.Before(a.Until)
+}
+
+// Aliases is a set of metric renamings. It's safe for concurrent use.
+type Aliases struct {
+	mu    sync.RWMutex
+	byOld map[string]*aliasState
+	byNew map[string]*aliasState
+	now   func() time.Time
+}
+
+type aliasState struct {
+	Alias
+	uses    atomic.Int64
+	lastLog atomic.Int64 // unix nanos
+}
+
+// NewAliases makes a set of aliases. See Add for possible errors.
+func NewAliases(aliases ...Alias) (*Aliases, error) {
+	a := &Aliases{
+		byOld: make(map[string]*aliasState),
+		byNew: make(map[string]*aliasState),
+		now:   time.Now,
+	}
+	for _, alias := range aliases {
+		if err := a.Add(alias); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Add an alias. Names can only be part of one alias, and chains of aliases aren't
+// supported: if a name is already an old or new name in the set, AliasConflict is returned.
+func (a *Aliases) Add(alias Alias) error {
+	if _, err := metricName(alias.New); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, name := range []string{alias.Old, alias.New} {
+		if a.byOld[name] != nil || a.byNew[name] != nil {
+			return AliasConflict
+		}
+	}
+	state := &aliasState{Alias: alias}
+	a.byOld[alias.Old] = state
+	a.byNew[alias.New] = state
+	return nil
+}
+
+// Uses is the number of times a metric has been written under the deprecated name old.
+func (a *Aliases) Uses(old string) int64 {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if state, ok := a.byOld[old]; ok {
+		return state.uses.Load()
+	}
+	return 0
+}
+
+// names returns the names a metric recorded as name should be written under
+func (a *Aliases) names(ctx context.Context, name string) []string {
+	a.mu.RLock()
+	old, isOld := a.byOld[name]
+	current, isNew := a.byNew[name]
+	a.mu.RUnlock()
+	now := a.now()
+	switch {
+	case isOld:
+		old.used(ctx, now)
+		if old.dualWrite(now) {
+			return []string{old.New, old.Old}
+		}
+		return []string{old.New}
+	case isNew && current.dualWrite(now):
+		return []string{current.New, current.Old}
+	}
+	return nil
+}
+
+func (state *aliasState) used(ctx context.Context, now time.Time) {
+	state.uses.Add(1)
+	last := state.lastLog.Load()
+	if now.UnixNano()-last < int64(deprecationLogInterval) || !state.lastLog.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	warnf(ctx, "Deprecated metric name %s is still in use (%d times so far); use %s instead",
+		state.Old, state.uses.Load(), state.New)
+}
+
+// WithAliases wraps sink so that aliased metrics are written under their old and/or
+// new names, as described at the top of alias.go.
+func WithAliases(sink Sink, aliases *Aliases) Sink {
+	return newTransformSink(sink, func(ctx context.Context, m Metric) []Metric {
+		names := aliases.names(ctx, m.Name())
+		if names == nil {
+			return []Metric{m}
+		}
+		out := make([]Metric, len(names))
+		for i, name := range names {
+			out[i] = withIdentity(m, name, tagsOf(m))
+		}
+		return out
+	})
+}
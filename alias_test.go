@@ -0,0 +1,48 @@
+package stats
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAliases(t *testing.T) {
+	now := time.Now()
+	aliases, err := NewAliases(Alias{Old: "user_signup", New: "users/signup", Until: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("Error making aliases: %s", err)
+	}
+	if err := aliases.Add(Alias{Old: "users/signup", New: "users/new"}); err != AliasConflict {
+		t.Errorf("Expected %s, got %v", AliasConflict, err)
+	}
+	aliases.now = func() time.Time { return now }
+	sink := &recordingSink{}
+	aliased := WithAliases(sink, aliases)
+	ctx := context.Background()
+	aliased.WriteCounters(ctx, makeCounter("user_signup"), makeCounter("users/signup"), makeCounter("other"))
+	expected := []string{"users/signup", "user_signup", "users/signup", "user_signup", "other"}
+	checkNames(t, sink.counters, expected)
+	if uses := aliases.Uses("user_signup"); uses != 1 {
+		t.Errorf("Expected 1 use of the deprecated name, got %d", uses)
+	}
+
+	aliases.now = func() time.Time { return now.Add(2 * time.Hour) }
+	sink.counters = nil
+	aliased.WriteCounters(ctx, makeCounter("user_signup"), makeCounter("users/signup"))
+	checkNames(t, sink.counters, []string{"users/signup", "users/signup"})
+	if uses := aliases.Uses("user_signup"); uses != 2 {
+		t.Errorf("Expected 2 uses of the deprecated name, got %d", uses)
+	}
+}
+
+func checkNames(t *testing.T, counters []*Counter, expected []string) {
+	t.Helper()
+	if len(counters) != len(expected) {
+		t.Fatalf("Expected %d counters, got %d", len(expected), len(counters))
+	}
+	for i, c := range counters {
+		if c.Name() != expected[i] {
+			t.Errorf("Counter %d: expected %s, got %s", i, expected[i], c.Name())
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package stats
+
+// A BreakerSink stops writing to a backend that's down, instead of having every
+// request wait on it to fail:
+//
+//	breaker := stats.Breaker(stackdriver.Sink, stats.BreakerPolicy{Name: "stackdriver", Buffer: 5000})
+//	router.Use(stats.Metrics(breaker))
+//
+// The breaker starts out closed, passing writes through. After FailureThreshold
+// consecutive failures it opens, and writes are shed (or held in a buffer, up to
+// Buffer metrics) without touching the backend. Once OpenTimeout has passed, the
+// breaker goes half-open and lets a limited number of writes through as trials. If a
+// trial succeeds the breaker closes and the buffer is written; if it fails, the
+// breaker opens again for another OpenTimeout. Closing the BreakerSink makes one last
+// attempt to write the buffer, whatever the breaker's state.
+//
+// Errors that are marked as not retryable (see Retryable) show the backend is up, so
+// they don't count as failures. When combining a BreakerSink with a RetrySink, put the
+// RetrySink outside: it retries in the background, so a breaker around it would never
+// see a retryable failure. CircuitOpen isn't retryable, so writes shed by an open
+// breaker aren't retried.
+//
+// The breaker's state is available from State and Healthy, and each change of state
+// is written as a gauge named BreakerStateMetric (tagged with the breaker's name) to
+// the policy's StateSink, if there is one.
+
+import (
+	"context"
+	"errors"
+	"github.com/efixler/multierror"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var CircuitOpen = errors.New("Circuit breaker is open, metrics were not written")
+
+// BreakerStateMetric is the name of the gauge that reports breaker states.
+const BreakerStateMetric = "stats/breaker/state"
+
+// BreakerState is the state of a BreakerSink. It's also the value of its state gauge.
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerPolicy configures a BreakerSink. Zero fields get the defaults noted.
+type BreakerPolicy struct {
+	Name             string        // Tags the state gauge, and log messages (default "sink")
+	FailureThreshold int           // Consecutive failures that open the breaker (default 5)
+	OpenTimeout      time.Duration // Time the breaker stays open before trials (default 30s)
+	HalfOpenTrials   int           // Trial writes allowed at once while half-open (default 1)
+	Buffer           int           // Metrics to hold while open; 0 means shed them all
+	StateSink        Sink          // Where state changes are written, if anywhere
+}
+
+func (p BreakerPolicy) withDefaults() BreakerPolicy {
+	if p.Name == "" {
+		p.Name = "sink"
+	}
+	if p.FailureThreshold <= 0 {
+		p.FailureThreshold = 5
+	}
+	if p.OpenTimeout <= 0 {
+		p.OpenTimeout = 30 * time.Second
+	}
+	if p.HalfOpenTrials <= 0 {
+		p.HalfOpenTrials = 1
+	}
+	return p
+}
+
+// BreakerSink is a circuit breaker in front of a Sink. See the top of breaker.go.
+type BreakerSink struct {
+	sink     Sink
+	policy   BreakerPolicy
+	now      func() time.Time
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	trials   int
+	buffer   Batch
+	shed     atomic.Int64
+}
+
+// Breaker wraps sink in a BreakerSink. The sink's own name translation is applied to
+// what's written to it.
+func Breaker(sink Sink, policy BreakerPolicy) *BreakerSink {
+	return &BreakerSink{sink: withNameTranslation(sink), policy: policy.withDefaults(), now: time.Now}
+}
+
+// State of the breaker. An open breaker whose timeout has passed reports BreakerOpen
+// until the next write makes it half-open.
+func (b *BreakerSink) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Shed is the number of metrics that have been dropped because the breaker was open,
+// including buffered metrics that couldn't be written on Close.
+func (b *BreakerSink) Shed() int64 {
+	return b.shed.Load()
+}
+
+// Healthy returns CircuitOpen unless the breaker is closed, and otherwise asks the
+// wrapped sink.
+func (b *BreakerSink) Healthy(ctx context.Context) error {
+	if b.State() != BreakerClosed {
+		return CircuitOpen
+	}
+	return CheckHealth(ctx, b.sink)
+}
+
+func (b *BreakerSink) WriteCounters(ctx context.Context, counters ...*Counter) error {
+	batch := make(Batch, len(counters))
+	for i, c := range counters {
+		batch[i] = c
+	}
+	return b.WriteBatch(ctx, batch)
+}
+
+func (b *BreakerSink) WriteTimers(ctx context.Context, timers ...*Timer) error {
+	batch := make(Batch, len(timers))
+	for i, t := range timers {
+		batch[i] = t
+	}
+	return b.WriteBatch(ctx, batch)
+}
+
+func (b *BreakerSink) WriteGauges(ctx context.Context, gauges ...*Gauge) error {
+	batch := make(Batch, len(gauges))
+	for i, g := range gauges {
+		batch[i] = g
+	}
+	return b.WriteBatch(ctx, batch)
+}
+
+func (b *BreakerSink) WriteHistograms(ctx context.Context, histograms ...*Histogram) error {
+	batch := make(Batch, len(histograms))
+	for i, h := range histograms {
+		batch[i] = h
+	}
+	return b.WriteBatch(ctx, batch)
+}
+
+// WriteBatch writes the batch if the breaker allows it. Writes that are buffered
+// return nil; writes that are shed return CircuitOpen.
+func (b *BreakerSink) WriteBatch(ctx context.Context, batch Batch) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	verdict := b.admit(ctx, batch)
+	switch verdict {
+	case breakerBuffered:
+		return nil
+	case breakerShed:
+		return CircuitOpen
+	}
+	err := WriteBatch(ctx, b.sink, batch)
+	if buffered := b.record(ctx, verdict == breakerTrial, err); len(buffered) > 0 {
+		if err := b.WriteBatch(ctx, buffered); err != nil {
+			reportError(ctx, err, "Error writing metrics buffered by the %s circuit breaker", b.policy.Name)
+		}
+	}
+	return err
+}
+
+// What the breaker does with a write
+type breakerVerdict int
+
+const (
+	breakerPass breakerVerdict = iota
+	breakerTrial
+	breakerBuffered
+	breakerShed
+)
+
+func (b *BreakerSink) admit(ctx context.Context, batch Batch) breakerVerdict {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.policy.OpenTimeout {
+		b.transition(ctx, BreakerHalfOpen)
+	}
+	switch {
+	case b.state == BreakerClosed:
+		return breakerPass
+	case b.state == BreakerHalfOpen && b.trials < b.policy.HalfOpenTrials:
+		b.trials++
+		return breakerTrial
+	case len(b.buffer)+len(batch) <= b.policy.Buffer:
+		b.buffer = append(b.buffer, batch...)
+		return breakerBuffered
+	}
+	b.shed.Add(int64(len(batch)))
+	return breakerShed
+}
+
+// record the outcome of a write, returning the buffer if the write closed the breaker
+func (b *BreakerSink) record(ctx context.Context, trial bool, err error) Batch {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if trial {
+		b.trials--
+	}
+	if err == nil || isPermanent(err) {
+		b.failures = 0
+		if b.state == BreakerClosed {
+			return nil
+		}
+		b.transition(ctx, BreakerClosed)
+		buffered := b.buffer
+		b.buffer = nil
+		return buffered
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.policy.FailureThreshold) {
+		b.openedAt = b.now()
+		b.transition(ctx, BreakerOpen)
+	}
+	return nil
+}
+
+// transition changes the state and reports it. It must be called with the lock held.
+func (b *BreakerSink) transition(ctx context.Context, state BreakerState) {
+	if state == b.state {
+		return
+	}
+	warnf(ctx, "Circuit breaker for %s is now %s (was %s)", b.policy.Name, state, b.state)
+	b.state = state
+	if b.policy.StateSink == nil {
+		return
+	}
+	g := makeGauge(BreakerStateMetric)
+	g.Set(int(state))
+	g.tags = Tags{"sink": b.policy.Name}
+	go func() {
+		if err := WriteGauges(context.WithoutCancel(ctx), b.policy.StateSink, g); err != nil {
+			reportError(ctx, err, "Error reporting circuit breaker state for %s", b.policy.Name)
+		}
+	}()
+}
+
+// isPermanent is true if every error in err is marked as not retryable
+func isPermanent(err error) bool {
+	for _, e := range flatten(err) {
+		var r Retryable
+		if !errors.As(e, &r) || r.Retryable() {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *BreakerSink) Flush(ctx context.Context) error {
+	return FlushSink(ctx, b.sink)
+}
+
+// Close tries to write whatever is buffered, and then closes the wrapped sink if it's
+// a Closer. If the buffer can't be written, its metrics are counted as shed and the
+// error is returned.
+func (b *BreakerSink) Close() error {
+	b.mu.Lock()
+	buffered := b.buffer
+	b.buffer = nil
+	b.mu.Unlock()
+	me := make(multierror.MultiError, 0)
+	if len(buffered) > 0 {
+		if err := WriteBatch(context.Background(), b.sink, buffered); err != nil {
+			b.shed.Add(int64(len(buffered)))
+			me = append(me, err)
+		}
+	}
+	if err := CloseSink(b.sink); err != nil {
+		me = append(me, err)
+	}
+	return me.NilWhenEmpty()
+}
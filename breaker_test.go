@@ -0,0 +1,91 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreakerSink(t *testing.T) {
+	ctx := context.Background()
+	down := &flakySink{failures: 3, err: errors.New("unavailable")}
+	state := &capableSink{}
+	b := Breaker(down, BreakerPolicy{FailureThreshold: 2, OpenTimeout: time.Minute, Buffer: 1, StateSink: state})
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		b.WriteCounters(ctx, testCounter("test/counter", 1))
+	}
+	if b.State() != BreakerOpen || down.calls != 2 {
+		t.Fatalf("Expected the breaker to open after 2 failures, got %s after %d calls", b.State(), down.calls)
+	}
+	if err := b.Healthy(ctx); err != CircuitOpen {
+		t.Errorf("Expected %s, got %v", CircuitOpen, err)
+	}
+	if err := b.WriteCounters(ctx, testCounter("test/buffered", 1)); err != nil {
+		t.Errorf("Expected the first write to be buffered, got %v", err)
+	}
+	if err := b.WriteCounters(ctx, testCounter("test/counter", 1)); err != CircuitOpen {
+		t.Errorf("Expected %s once the buffer is full, got %v", CircuitOpen, err)
+	}
+	if down.calls != 2 || b.Shed() != 1 {
+		t.Errorf("Expected writes to be held back while open, got %d calls and %d shed", down.calls, b.Shed())
+	}
+
+	// a failed trial opens the breaker again
+	now = now.Add(time.Minute)
+	b.WriteCounters(ctx, testCounter("test/counter", 1))
+	if b.State() != BreakerOpen || down.calls != 3 {
+		t.Fatalf("Expected a failed trial to reopen the breaker, got %s after %d calls", b.State(), down.calls)
+	}
+
+	// and a successful one closes it, writing the buffer
+	now = now.Add(time.Minute)
+	if err := b.WriteCounters(ctx, testCounter("test/counter", 1)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if b.State() != BreakerClosed || len(down.counters) != 2 || down.counters[1].Name() != "test/buffered" {
+		t.Errorf("Expected the breaker to close and write the buffer, got %s and %v", b.State(), down.counters)
+	}
+	waitFor(t, func() bool {
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		return len(state.gauges) == 5 // open, half-open, open, half-open, closed
+	})
+}
+
+func TestBreakerIgnoresPermanentErrors(t *testing.T) {
+	rejecting := &flakySink{failures: 10, err: MarkRetryable(errors.New("400"), false)}
+	b := Breaker(rejecting, BreakerPolicy{FailureThreshold: 1})
+	for i := 0; i < 3; i++ {
+		b.WriteCounters(context.Background(), testCounter("test/counter", 1))
+	}
+	if b.State() != BreakerClosed || rejecting.calls != 3 {
+		t.Errorf("Expected permanent errors to leave the breaker closed, got %s", b.State())
+	}
+}
+
+func TestBreakerCloseWritesBuffer(t *testing.T) {
+	ctx := context.Background()
+	down := &flakySink{failures: 2, err: errors.New("unavailable")}
+	b := Breaker(down, BreakerPolicy{FailureThreshold: 1, OpenTimeout: time.Minute, Buffer: 10})
+	b.WriteCounters(ctx, testCounter("test/counter", 1))
+	b.WriteCounters(ctx, testCounter("test/buffered", 1))
+	if b.State() != BreakerOpen {
+		t.Fatalf("Expected the breaker to be open, got %s", b.State())
+	}
+	// the first attempt on close fails, so the buffered counter is shed
+	if err := b.Close(); err == nil || b.Shed() != 1 {
+		t.Errorf("Expected the failed final write to be returned and counted, got %v and %d shed", err, b.Shed())
+	}
+
+	b = Breaker(down, BreakerPolicy{FailureThreshold: 1, OpenTimeout: time.Minute, Buffer: 10})
+	down.failures = 1
+	b.WriteCounters(ctx, testCounter("test/counter", 1))
+	b.WriteCounters(ctx, testCounter("test/buffered", 1))
+	if err := b.Close(); err != nil || len(down.counters) != 1 || down.counters[0].Name() != "test/buffered" {
+		t.Errorf("Expected the buffer to be written on close, got %v and %v", err, down.counters)
+	}
+}
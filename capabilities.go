@@ -0,0 +1,151 @@
+package stats
+
+// Sinks only have to implement the two methods of the Sink interface. Everything
+// else a sink can do is advertised by implementing one or more of the optional
+// interfaces in this file, which the stats pipeline discovers with type assertions.
+// When a sink doesn't implement one of them, the pipeline falls back to something
+// the base interface can handle:
+//
+//	GaugeWriter      gauges are dropped
+//	HistogramWriter  each observation is written as a Timer
+//	BatchWriter      the batch is split up by kind and written with the other methods
+//	Flusher          nothing to flush
+//	Closer           nothing to close
+//	HealthChecker    the sink is assumed to be healthy
+//
+// The functions WriteGauges, WriteHistograms, WriteBatch, FlushSink, CloseSink and
+// CheckHealth implement the discovery and the fallbacks. Use them when writing a
+// Sink that wraps another Sink, so that your wrapper passes the inner sink's
+// capabilities through.
+
+import (
+	"context"
+	"github.com/efixler/multierror"
+)
+
+// GaugeWriter is implemented by sinks that can store gauges.
+type GaugeWriter interface {
+	WriteGauges(ctx context.Context, gauges ...*Gauge) error
+}
+
+// HistogramWriter is implemented by sinks that can store distributions.
+type HistogramWriter interface {
+	WriteHistograms(ctx context.Context, histograms ...*Histogram) error
+}
+
+// Flusher is implemented by sinks that buffer writes.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// Closer is implemented by sinks that hold resources which should be released.
+type Closer interface {
+	Close() error
+}
+
+// HealthChecker is implemented by sinks that can report whether their backend is usable.
+type HealthChecker interface {
+	Healthy(ctx context.Context) error
+}
+
+// Batch is a mixed set of metrics.
+type Batch []Metric
+
+// BatchWriter is implemented by sinks that can write a mix of metrics at once.
+type BatchWriter interface {
+	WriteBatch(ctx context.Context, batch Batch) error
+}
+
+// WriteGauges writes gauges to sink if it's a GaugeWriter, and drops them otherwise.
+func WriteGauges(ctx context.Context, sink Sink, gauges ...*Gauge) error {
+	if gw, ok := sink.(GaugeWriter); ok && len(gauges) > 0 {
+		return gw.WriteGauges(ctx, gauges...)
+	}
+	return nil
+}
+
+// WriteHistograms writes histograms to sink if it's a HistogramWriter. Otherwise each
+// observation in each histogram is written as a Timer.
+func WriteHistograms(ctx context.Context, sink Sink, histograms ...*Histogram) error {
+	if len(histograms) == 0 {
+		return nil
+	} else if hw, ok := sink.(HistogramWriter); ok {
+		return hw.WriteHistograms(ctx, histograms...)
+	}
+	timers := make([]*Timer, 0, len(histograms))
+	for _, h := range histograms {
+		timers = append(timers, h.timers()...)
+	}
+	if len(timers) == 0 {
+		return nil
+	}
+	return sink.WriteTimers(ctx, timers...)
+}
+
+// WriteBatch writes batch to sink with WriteBatch if it's a BatchWriter. Otherwise the
+// batch is split up by kind and written with the other Write methods and functions.
+func WriteBatch(ctx context.Context, sink Sink, batch Batch) error {
+	if len(batch) == 0 {
+		return nil
+	} else if bw, ok := sink.(BatchWriter); ok {
+		return bw.WriteBatch(ctx, batch)
+	}
+	var counters []*Counter
+	var timers []*Timer
+	var gauges []*Gauge
+	var histograms []*Histogram
+	for _, m := range batch {
+		switch m := m.(type) {
+		case *Counter:
+			counters = append(counters, m)
+		case *Timer:
+			timers = append(timers, m)
+		case *Gauge:
+			gauges = append(gauges, m)
+		case *Histogram:
+			histograms = append(histograms, m)
+		}
+	}
+	me := make(multierror.MultiError, 0)
+	if len(counters) > 0 {
+		if err := sink.WriteCounters(ctx, counters...); err != nil {
+			me = append(me, err)
+		}
+	}
+	if len(timers) > 0 {
+		if err := sink.WriteTimers(ctx, timers...); err != nil {
+			me = append(me, err)
+		}
+	}
+	if err := WriteGauges(ctx, sink, gauges...); err != nil {
+		me = append(me, err)
+	}
+	if err := WriteHistograms(ctx, sink, histograms...); err != nil {
+		me = append(me, err)
+	}
+	return me.NilWhenEmpty()
+}
+
+// FlushSink flushes sink if it's a Flusher.
+func FlushSink(ctx context.Context, sink Sink) error {
+	if f, ok := sink.(Flusher); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
+
+// CloseSink closes sink if it's a Closer.
+func CloseSink(sink Sink) error {
+	if c, ok := sink.(Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// CheckHealth asks sink if it's healthy, if it's a HealthChecker.
+func CheckHealth(ctx context.Context, sink Sink) error {
+	if hc, ok := sink.(HealthChecker); ok {
+		return hc.Healthy(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// capableSink implements all of the optional interfaces
+type capableSink struct {
+	recordingSink
+	gauges     []*Gauge
+	histograms []*Histogram
+	batches    int
+	flushes    int
+	closed     bool
+	health     error
+}
+
+func (cs *capableSink) WriteGauges(ctx context.Context, gauges ...*Gauge) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.gauges = append(cs.gauges, gauges...)
+	return nil
+}
+
+func (cs *capableSink) WriteHistograms(ctx context.Context, histograms ...*Histogram) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.histograms = append(cs.histograms, histograms...)
+	return nil
+}
+
+func (cs *capableSink) WriteBatch(ctx context.Context, batch Batch) error {
+	for _, m := range batch {
+		switch m := m.(type) {
+		case *Gauge:
+			cs.WriteGauges(ctx, m)
+		case *Histogram:
+			cs.WriteHistograms(ctx, m)
+		default:
+			WriteBatch(ctx, &cs.recordingSink, Batch{m})
+		}
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.batches++
+	return nil
+}
+
+func (cs *capableSink) Flush(ctx context.Context) error {
+	cs.flushes++
+	return nil
+}
+
+func (cs *capableSink) Close() error {
+	cs.closed = true
+	return nil
+}
+
+func (cs *capableSink) Healthy(ctx context.Context) error {
+	return cs.health
+}
+
+func testHistogram(name string, ds ...time.Duration) *Histogram {
+	h := makeHistogram(name)
+	for _, d := range ds {
+		h.Observe(d)
+	}
+	return h
+}
+
+func TestHistogramFallback(t *testing.T) {
+	ctx := context.Background()
+	sink := &recordingSink{}
+	h := testHistogram("test/histogram", time.Millisecond, 2*time.Millisecond)
+	if err := WriteHistograms(ctx, sink, h); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(sink.timers) != 2 {
+		t.Fatalf("Expected 2 timers, got %d", len(sink.timers))
+	}
+	if sink.timers[1].Name() != "test/histogram" || sink.timers[1].Milliseconds() != 2 {
+		t.Errorf("Expected test/histogram at 2ms, got %s at %dms", sink.timers[1].Name(), sink.timers[1].Milliseconds())
+	}
+
+	capable := &capableSink{}
+	if err := WriteHistograms(ctx, capable, h); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(capable.histograms) != 1 || len(capable.timers) != 0 {
+		t.Errorf("Expected the histogram to be written as is, got %d histograms and %d timers",
+			len(capable.histograms), len(capable.timers))
+	}
+}
+
+func TestWriteBatchSplitsByKind(t *testing.T) {
+	ctx := context.Background()
+	c := makeCounter("test/counter")
+	c.Increment()
+	g := makeGauge("test/gauge")
+	g.Set(7)
+	batch := Batch{c, g, testHistogram("test/histogram", time.Millisecond)}
+
+	sink := &recordingSink{}
+	if err := WriteBatch(ctx, sink, batch); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(sink.counters) != 1 || len(sink.timers) != 1 {
+		t.Errorf("Expected a counter and a timer (with the gauge dropped), got %d counters and %d timers",
+			len(sink.counters), len(sink.timers))
+	}
+
+	capable := &capableSink{}
+	if err := WriteBatch(ctx, capable, batch); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if capable.batches != 1 || len(capable.gauges) != 1 || capable.gauges[0].Value() != 7 {
+		t.Errorf("Expected one batch including the gauge, got %d batches and gauges %v", capable.batches, capable.gauges)
+	}
+}
+
+func TestTransformSinkPassesCapabilities(t *testing.T) {
+	ctx := context.Background()
+	capable := &capableSink{health: errors.New("down")}
+	sink := TranslateNames(capable, GraphiteNames)
+	g := makeGauge("test/gauge")
+	if err := WriteGauges(ctx, sink, g); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(capable.gauges) != 1 || capable.gauges[0].Name() != "test.gauge" {
+		t.Errorf("Expected a translated gauge, got %v", capable.gauges)
+	}
+	if g.Name() != "test/gauge" {
+		t.Errorf("Original gauge was modified: %s", g.Name())
+	}
+	if err := CheckHealth(ctx, sink); err != capable.health {
+		t.Errorf("Expected health %v, got %v", capable.health, err)
+	}
+	FlushSink(ctx, sink)
+	CloseSink(sink)
+	if capable.flushes != 1 || !capable.closed {
+		t.Errorf("Expected flush and close to reach the wrapped sink")
+	}
+	if err := CheckHealth(ctx, &recordingSink{}); err != nil {
+		t.Errorf("Sinks without a health check should be healthy, got %s", err)
+	}
+}
+
+func TestRequestGaugesAndHistograms(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sink := &capableSink{}
+	rctx := initRequestContext(ctx, newRequestStats(), sink)
+	SetGauge(rctx, "test/gauge", 1)
+	SetGauge(rctx, "test/gauge", 5)
+	Observe(rctx, "test/histogram", time.Millisecond)
+	Observe(rctx, "test/histogram", 3*time.Millisecond)
+	Increment(rctx, "test/counter")
+	cancel()
+	waitFor(t, func() bool {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		return sink.batches == 1
+	})
+	if len(sink.gauges) != 1 || sink.gauges[0].Value() != 5 {
+		t.Errorf("Expected the last gauge value, got %v", sink.gauges)
+	}
+	if len(sink.histograms) != 1 || len(sink.histograms[0].Observations()) != 2 {
+		t.Errorf("Expected one histogram with 2 observations, got %v", sink.histograms)
+	}
+	if len(sink.counters) != 1 {
+		t.Errorf("Expected one counter, got %d", len(sink.counters))
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,150 @@
+package stats
+
+// Cardinality limits guard against runaway metric names and tag values, e.g. a bug that
+// puts user IDs into bucket names. Anything beyond a limit is collapsed into an overflow
+// series rather than dropped, so the total counts stay right. Offending metrics are
+// logged (once each), and Overflows keeps a running total.
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Offending metrics are logged once each, up to this many
+const maxOverflowWarnings = 1000
+
+// OverflowName is the name of the bucket that metrics are collapsed into when a
+// cardinality limit is exceeded. When a tag limit is exceeded, the overflowing tag
+// values are replaced with OverflowName instead.
+const OverflowName = "__overflow__"
+
+// Limits on the cardinality of recorded metrics. Zero means no limit.
+type Limits struct {
+	MaxNames             int // Distinct metric names per process
+	MaxBucketsPerRequest int // Distinct buckets (of all kinds) per request
+}
+
+var (
+	limits     atomic.Pointer[Limits]
+	knownNames sync.Map // name -> struct{}
+	nameCount  atomic.Int64
+	warned     sync.Map // offending metric -> struct{}, so each one is only logged once
+	warnings   atomic.Int64
+	overflows  atomic.Int64
+)
+
+func init() {
+	limits.Store(&Limits{})
+}
+
+// SetLimits changes the cardinality limits. Names that were seen before the change
+// continue to count toward the MaxNames limit.
+func SetLimits(l Limits) {
+	limits.Store(&l)
+}
+
+// CurrentLimits returns the limits set with SetLimits.
+func CurrentLimits() Limits {
+	return *limits.Load()
+}
+
+// Overflows is the number of times a metric has been collapsed into an overflow
+// series since the process started.
+func Overflows() int64 {
+	return overflows.Load()
+}
+
+// admitName returns name if it's within the process-wide name limit, OverflowName otherwise
+func admitName(ctx context.Context, name string) string {
+	max := limits.Load().MaxNames
+	if max <= 0 {
+		return name
+	} else if _, ok := knownNames.Load(name); ok {
+		return name
+	}
+	if nameCount.Add(1) > int64(max) {
+		nameCount.Add(-1)
+		overflow(ctx, name, max, "distinct metric names per process")
+		return OverflowName
+	}
+	if _, loaded := knownNames.LoadOrStore(name, struct{}{}); loaded {
+		nameCount.Add(-1) // lost a race with another first use of the same name
+	}
+	return name
+}
+
+// admit a new bucket into the request, returning either name or OverflowName
+func (rs *requestStats) admit(name string) string {
+	if name = rs.admitBucket(name); name == OverflowName {
+		return name
+	}
+	return admitName(rs.ctx, name)
+}
+
+// admitBucket returns name if the request has room for another bucket, OverflowName otherwise
+func (rs *requestStats) admitBucket(name string) string {
+	max := limits.Load().MaxBucketsPerRequest
+	if max <= 0 {
+		return name
+	} else if len(rs.counters)+len(rs.timers)+len(rs.gauges)+len(rs.histograms) >= max {
+		overflow(rs.ctx, name, max, "buckets per request")
+		return OverflowName
+	}
+	return name
+}
+
+func overflow(ctx context.Context, offender string, max int, what string) {
+	overflows.Add(1)
+	if warnings.Load() >= maxOverflowWarnings {
+		return // runaway cardinality shouldn't turn into runaway memory use here
+	}
+	if _, loaded := warned.LoadOrStore(offender, struct{}{}); !loaded {
+		warnings.Add(1)
+		warnf(ctx, "Metric %s exceeds the limit of %d %s, collapsing it into %s", offender, max, what, OverflowName)
+	}
+}
+
+// LimitSeries wraps sink so that each metric name can have at most max distinct
+// combinations of tag values. Metrics with new tag combinations beyond the limit
+// are written with all of their tag values replaced by OverflowName.
+func LimitSeries(sink Sink, max int) Sink {
+	sl := &seriesLimiter{max: max, series: make(map[string]map[string]struct{})}
+	return newTransformSink(sink, sl.transform)
+}
+
+type seriesLimiter struct {
+	max    int
+	mu     sync.Mutex
+	series map[string]map[string]struct{} // name -> tag strings
+}
+
+func (sl *seriesLimiter) transform(ctx context.Context, m Metric) []Metric {
+	tags := tagsOf(m)
+	if len(tags) == 0 || sl.admit(m.Name(), tags.String()) {
+		return []Metric{m}
+	}
+	overflow(ctx, seriesKey(m.Name(), tags), sl.max, "tag combinations per metric")
+	collapsed := make(Tags, len(tags))
+	for k := range tags {
+		collapsed[k] = OverflowName
+	}
+	return []Metric{withIdentity(m, m.Name(), collapsed)}
+}
+
+func (sl *seriesLimiter) admit(name, tags string) bool {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	seen, ok := sl.series[name]
+	if !ok {
+		seen = make(map[string]struct{})
+		sl.series[name] = seen
+	}
+	if _, ok := seen[tags]; ok {
+		return true
+	} else if len(seen) >= sl.max {
+		return false
+	}
+	seen[tags] = struct{}{}
+	return true
+}
@@ -0,0 +1,82 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestBucketsPerRequestLimit(t *testing.T) {
+	defer SetLimits(Limits{})
+	SetLimits(Limits{MaxBucketsPerRequest: 3})
+	ctx := requestContextUsingMetrics()
+	for i := 0; i < 5; i++ {
+		if err := Increment(ctx, fmt.Sprintf("user/%d", i)); err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+	}
+	Increment(ctx, "user/0")
+	rs, _ := statsFromContext(ctx)
+	if len(rs.counters) != 4 {
+		t.Errorf("Expected 3 buckets plus overflow, got %d", len(rs.counters))
+	}
+	if c := rs.counters[OverflowName]; c == nil || c.Data() != 2 || c.Name() != OverflowName {
+		t.Errorf("Expected overflow counter with 2, got %v", c)
+	}
+	if c := rs.counters["user/0"]; c == nil || c.Data() != 2 {
+		t.Errorf("Buckets within the limit should be unaffected, got %v", c)
+	}
+	StartTimer(ctx, "overflowing/timer")
+	StartTimer(ctx, "overflowing/timer") // restarting keeps the admitted name
+	if timer := rs.timers["overflowing/timer"]; timer == nil || timer.Name() != OverflowName {
+		t.Errorf("Expected overflow timer, got %v", timer)
+	} else if err := FinishTimer(ctx, "overflowing/timer"); err != nil {
+		t.Errorf("Overflowed timers should still finish, got %s", err)
+	}
+}
+
+func TestNamesPerProcessLimit(t *testing.T) {
+	defer SetLimits(Limits{})
+	SetLimits(Limits{MaxNames: int(nameCount.Load()) + 2})
+	ctx := requestContextUsingMetrics()
+	before := Overflows()
+	for _, bucket := range []string{"process/one", "process/two", "process/three"} {
+		Increment(ctx, bucket)
+	}
+	rs, _ := statsFromContext(ctx)
+	if _, ok := rs.counters["process/three"]; ok {
+		t.Errorf("Third name should have overflowed")
+	}
+	if c := rs.counters[OverflowName]; c == nil || c.Data() != 1 {
+		t.Errorf("Expected overflow counter with 1, got %v", c)
+	}
+	if Overflows() != before+1 {
+		t.Errorf("Expected overflow count to go up by 1, got %d", Overflows()-before)
+	}
+	ctx = requestContextUsingMetrics()
+	Increment(ctx, "process/one")
+	rs, _ = statsFromContext(ctx)
+	if _, ok := rs.counters["process/one"]; !ok {
+		t.Errorf("Known names should be admitted in later requests")
+	}
+}
+
+func TestLimitSeries(t *testing.T) {
+	sink := &recordingSink{}
+	limited := LimitSeries(sink, 2)
+	for _, user := range []string{"a", "b", "c", "a"} {
+		c := makeCounter("logins")
+		c.tags = Tags{"user": user}
+		c.Increment()
+		limited.WriteCounters(context.Background(), c)
+	}
+	expected := []string{"user=a", "user=b", "user=" + OverflowName, "user=a"}
+	if len(sink.counters) != len(expected) {
+		t.Fatalf("Expected %d counters, got %d", len(expected), len(sink.counters))
+	}
+	for i, c := range sink.counters {
+		if c.Tags().String() != expected[i] {
+			t.Errorf("Counter %d: expected tags %s, got %s", i, expected[i], c.Tags())
+		}
+	}
+}
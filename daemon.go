@@ -11,37 +11,44 @@ package stats
 
 import (
 	"context"
-	"github.com/efixler/logger"
+	"fmt"
+	"time"
 )
 
 func openMetricsChannel(ctxo context.Context, sink Sink) chan<- Metric {
-	events := make(chan Metric)
+	var size int
+	if p, ok := pipelineFromContext(ctxo); ok {
+		size = p.bufferSize
+	}
+	events := make(chan Metric, size)
 	waitForRequestDone(ctxo, events)
 
 	runFunc := func(ctx context.Context) {
+		ctx = withPipelineOf(ctx, ctxo)
 		for {
 			select {
 			case event := <-events:
-				switch event.(type) {
-				// todo: batch processing for the following 2 cases
+				var err error
+				var what string
+				start := time.Now()
+				switch event := event.(type) {
 				case *Counter:
-					err := sink.WriteCounters(ctx, event.(*Counter))
-					if err != nil {
-						logger.Context.Errorf(ctx, "Error flushing counter: %s", err)
-					}
+					err, what = sink.WriteCounters(ctx, event), "counter"
 				case *Timer:
-					err := sink.WriteTimers(ctx, event.(*Timer))
-					if err != nil {
-						logger.Context.Errorf(ctx, "Error flushing timer: %s", err)
-					}
+					err, what = sink.WriteTimers(ctx, event), "timer"
+				case *batchEvent:
+					err, what = WriteBatch(ctx, sink, event.batch), "metrics"
 				case nil:
 					// when the channel is closed, we will see a nil value here
 					return
 				default:
 					// exit if unexpected stuff happens, so we don't leak
-					logger.Context.Errorf(ctx, "Unexpected event (type %T) passed to stat sink channel", event)
+					reportError(ctx, fmt.Errorf("unexpected event type %T", event), "Error reading stat sink channel")
 					return
-
+				}
+				recordWrite(countMetrics(event), time.Since(start), err)
+				if err != nil {
+					reportError(ctx, err, "Error flushing %s", what)
 				}
 			case <-ctx.Done():
 				// .Done() channel cannot be relied upon for background operations.
@@ -51,7 +58,7 @@ func openMetricsChannel(ctxo context.Context, sink Sink) chan<- Metric {
 	}
 	err := startEventsListener(ctxo, runFunc)
 	if err != nil {
-		logger.Context.Errorf(ctxo, "Can't start metrics listener, events will not be flushed: %s", err)
+		reportError(ctxo, err, "Can't start metrics listener, events will not be flushed")
 	}
 	return events
 }
@@ -60,8 +67,19 @@ func waitForRequestDone(ctx context.Context, evtChan chan<- Metric) {
 	go func(ctx context.Context) {
 		select {
 		case <-ctx.Done():
-			flushAll(ctx)
-			defer close(evtChan)
+			rs, ok := lockStats(ctx)
+			if ok {
+				rs.flushAll()
+				rs.eventChannel = nil // late writes get NoSink, rather than a closed channel
+				rs.mu.Unlock()
+			}
+			if evtChan != nil {
+				close(evtChan)
+			}
+			if ok {
+				runFlushHooks(ctx, rs)
+				releaseRequestStats(rs)
+			}
 		}
 	}(ctx)
 }
@@ -0,0 +1,204 @@
+package stats
+
+// DebugMetrics echoes a request's metrics back to the client, as JSON in a response
+// header, for seeing exactly what a request recorded:
+//
+//	router.Use(stats.Metrics(sink))
+//	router.Use(stats.DebugMetrics(stats.DebugPolicy{Key: key}))
+//
+// It's only done for requests that carry a token signed with the policy's key, in the
+// X-Stats-Debug header or the stats_debug query parameter. Make tokens with
+// SignDebugToken:
+//
+//	token := stats.SignDebugToken(key, time.Now().Add(time.Hour))
+//	// curl -H "X-Stats-Debug: $token" https://staging.example.com/...
+//
+// The header holds the metrics recorded before the response headers were sent. With
+// Trailer set, the complete set is sent in a trailer as well, once the handler is done.
+// Metrics too large for the header (see MaxSize) are replaced with a note saying so.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DebugMetricsHeader is the response header (and trailer) that carries the metrics.
+const DebugMetricsHeader = "X-Stats-Metrics"
+
+// DebugPolicy configures DebugMetrics. Zero fields get the defaults noted.
+type DebugPolicy struct {
+	Key     []byte // HMAC key for the tokens; with no key, the middleware does nothing
+	Header  string // Request header carrying the token (default "X-Stats-Debug")
+	Param   string // Query parameter carrying the token (default "stats_debug")
+	Trailer bool   // Send the complete set in a trailer too
+	MaxSize int    // Largest header value to send, in bytes (default 8192)
+}
+
+func (p DebugPolicy) withDefaults() DebugPolicy {
+	if p.Header == "" {
+		p.Header = "X-Stats-Debug"
+	}
+	if p.Param == "" {
+		p.Param = "stats_debug"
+	}
+	if p.MaxSize <= 0 {
+		p.MaxSize = 8192
+	}
+	return p
+}
+
+// SignDebugToken makes a token for DebugMetrics that's good until expires.
+func SignDebugToken(key []byte, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + debugSignature(key, exp)
+}
+
+func debugSignature(key []byte, exp string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(exp))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validDebugToken is true if token was signed with key and hasn't expired
+func validDebugToken(key []byte, token string, now time.Time) bool {
+	exp, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || now.Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(debugSignature(key, exp)))
+}
+
+func (p DebugPolicy) enabled(r *http.Request) bool {
+	if len(p.Key) == 0 {
+		return false
+	}
+	token := r.Header.Get(p.Header)
+	if token == "" {
+		token = r.URL.Query().Get(p.Param)
+	}
+	return token != "" && validDebugToken(p.Key, token, time.Now())
+}
+
+// DebugMetrics is middleware that returns the request's metrics in a response header
+// to requests with a valid token. It has to come after Metrics.
+func DebugMetrics(policy DebugPolicy) func(http.Handler) http.Handler {
+	policy = policy.withDefaults()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !hasStats(r.Context()) || !policy.enabled(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			rw := wrapResponse(w)
+			rw.onHeader(func(h http.Header) {
+				if rs, ok := lockStats(r.Context()); ok {
+					h.Set(DebugMetricsHeader, rs.debugJSON(policy.MaxSize))
+					rs.mu.Unlock()
+				}
+			})
+			next.ServeHTTP(rw, r)
+			rw.finish()
+			if rs, ok := lockStats(r.Context()); ok && policy.Trailer {
+				rw.Header().Set(http.TrailerPrefix+DebugMetricsHeader, rs.debugJSON(policy.MaxSize))
+				rs.mu.Unlock()
+			} else if ok {
+				rs.mu.Unlock()
+			}
+		})
+	}
+}
+
+// metricsDump is the JSON form of a request's metrics. Durations are in milliseconds.
+type metricsDump struct {
+	Counters   map[string]counterDump `json:"counters,omitempty"`
+	Timers     map[string]timerDump   `json:"timers,omitempty"`
+	Gauges     map[string]int         `json:"gauges,omitempty"`
+	Histograms map[string][]float64   `json:"histograms,omitempty"`
+}
+
+type counterDump struct {
+	Name     string  `json:"name,omitempty"` // as recorded, if it's different from the bucket
+	Count    int     `json:"count"`
+	Estimate int     `json:"estimate,omitempty"` // when sampled
+	Rate     float64 `json:"rate,omitempty"`     // when sampled
+}
+
+type timerDump struct {
+	Name    string  `json:"name,omitempty"`
+	Ms      float64 `json:"ms"`
+	Running bool    `json:"running,omitempty"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// dump the request's metrics as they are now. Timers that are still running are given
+// their elapsed time.
+func (rs *requestStats) dump() metricsDump {
+	d := metricsDump{
+		Counters:   make(map[string]counterDump, len(rs.counters)),
+		Timers:     make(map[string]timerDump, len(rs.finished)+len(rs.timers)),
+		Gauges:     make(map[string]int, len(rs.gauges)),
+		Histograms: make(map[string][]float64, len(rs.histograms)),
+	}
+	for bucket, c := range rs.counters {
+		cd := counterDump{Count: c.Data()}
+		if c.Name() != bucket {
+			cd.Name = c.Name()
+		}
+		if rate := c.SampleRate(); rate < 1 {
+			cd.Estimate, cd.Rate = c.Estimate(), rate
+		}
+		d.Counters[bucket] = cd
+	}
+	for bucket, dur := range rs.finished {
+		d.Timers[bucket] = timerDump{Ms: milliseconds(dur)}
+	}
+	now := rs.now().UnixNano()
+	for bucket, t := range rs.timers {
+		td := timerDump{Ms: milliseconds(time.Duration(t.Duration()))}
+		if !t.Finished() {
+			td.Ms, td.Running = milliseconds(time.Duration(now-t.startTime)), true
+		}
+		if t.Name() != bucket {
+			td.Name = t.Name()
+		}
+		d.Timers[bucket] = td
+	}
+	for bucket, g := range rs.gauges {
+		d.Gauges[bucket] = g.Value()
+	}
+	for bucket, h := range rs.histograms {
+		obs := make([]float64, len(h.Observations()))
+		for i, o := range h.Observations() {
+			obs[i] = milliseconds(o)
+		}
+		d.Histograms[bucket] = obs
+	}
+	return d
+}
+
+// debugJSON is the dump as JSON, or a note if it's longer than max
+func (rs *requestStats) debugJSON(max int) string {
+	d := rs.dump()
+	b, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Sprintf(`{"error":%q}`, err.Error())
+	} else if len(b) > max {
+		return fmt.Sprintf(`{"truncated":true,"size":%d,"counters":%d,"timers":%d,"gauges":%d,"histograms":%d}`,
+			len(b), len(d.Counters), len(d.Timers), len(d.Gauges), len(d.Histograms))
+	}
+	return string(b)
+}
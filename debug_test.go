@@ -0,0 +1,80 @@
+package stats
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebugTokens(t *testing.T) {
+	key := []byte("secret")
+	now := time.Now()
+	token := SignDebugToken(key, now.Add(time.Hour))
+	if !validDebugToken(key, token, now) {
+		t.Errorf("Token %s should be valid", token)
+	}
+	if validDebugToken([]byte("other"), token, now) {
+		t.Errorf("Token signed with another key shouldn't be valid")
+	}
+	if validDebugToken(key, token, now.Add(2*time.Hour)) {
+		t.Errorf("Expired token shouldn't be valid")
+	}
+	exp, sig, _ := strings.Cut(token, ".")
+	if validDebugToken(key, exp+"0."+sig, now) || validDebugToken(key, "garbage", now) {
+		t.Errorf("Tampered tokens shouldn't be valid")
+	}
+}
+
+func TestDebugMetrics(t *testing.T) {
+	key := []byte("secret")
+	mw := chain(Metrics(nil), DebugMetrics(DebugPolicy{Key: key, Trailer: true}))
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		Increment(r.Context(), "test/counter")
+		StartTimer(r.Context(), "test/timer")
+		FinishTimer(r.Context(), "test/timer")
+		w.Write([]byte("hello"))
+		SetGauge(r.Context(), "test/gauge", 3)
+	}
+
+	if w := serve(mw, handler); w.Header().Get(DebugMetricsHeader) != "" {
+		t.Errorf("Metrics shouldn't be sent without a token")
+	}
+	r := httptest.NewRequest("GET", "/?stats_debug="+SignDebugToken([]byte("wrong"), time.Now().Add(time.Hour)), nil)
+	if w := serveRequest(mw, r, handler); w.Header().Get(DebugMetricsHeader) != "" {
+		t.Errorf("Metrics shouldn't be sent with a bad token")
+	}
+
+	r = httptest.NewRequest("GET", "/?stats_debug="+SignDebugToken(key, time.Now().Add(time.Hour)), nil)
+	res := serveRequest(mw, r, handler).Result()
+	var header, trailer metricsDump
+	if err := json.Unmarshal([]byte(res.Header.Get(DebugMetricsHeader)), &header); err != nil {
+		t.Fatalf("Can't decode header: %s", err)
+	}
+	if header.Counters["test/counter"].Count != 1 || len(header.Timers) != 1 || len(header.Gauges) != 0 {
+		t.Errorf("Expected the metrics from before the write in the header, got %+v", header)
+	}
+	if err := json.Unmarshal([]byte(res.Trailer.Get(DebugMetricsHeader)), &trailer); err != nil {
+		t.Fatalf("Can't decode trailer: %s", err)
+	}
+	if trailer.Gauges["test/gauge"] != 3 {
+		t.Errorf("Expected the complete set in the trailer, got %+v", trailer)
+	}
+}
+
+func TestDebugJSONLimit(t *testing.T) {
+	ctx := requestContextUsingMetrics()
+	rs, _ := statsFromContext(ctx)
+	StartTimer(ctx, "test/running")
+	Increment(ctx, "test/counter")
+	var d metricsDump
+	json.Unmarshal([]byte(rs.debugJSON(8192)), &d)
+	if !d.Timers["test/running"].Running {
+		t.Errorf("Expected a running timer, got %+v", d.Timers)
+	}
+	if v := rs.debugJSON(10); !strings.HasPrefix(v, `{"truncated":true`) {
+		t.Errorf("Expected a truncation note, got %s", v)
+	}
+}
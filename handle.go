@@ -0,0 +1,121 @@
+package stats
+
+// Handles are pre-registered metric buckets. They are meant to be created once,
+// at init time, and then used on hot paths:
+//
+//	var cacheHits = stats.NewCounter("cache.hit")
+//
+//	func lookup(ctx context.Context, key string) {
+//	    ...
+//	    cacheHits.Increment(ctx)
+//	}
+//
+// A handle's name is validated when the handle is created, so recording through
+// a handle does no name checking at all, and incrementing a counter that has
+// already been used in the request does not allocate. (A strict registry is still
+// consulted when the handle's bucket is first used in a request, and so is the
+// pipeline's NamePolicy, if it has its own; see WithNamePolicy.)
+
+import (
+	"context"
+	"fmt"
+)
+
+// CounterHandle is a pre-validated counter bucket. Make one with NewCounter.
+type CounterHandle struct {
+	bucket string
+	name   string // as resolved by the NamePolicy
+}
+
+// NewCounter returns a handle for the named counter bucket. Since handles are
+// generally package-level variables, NewCounter panics if the name is illegal,
+// in the manner of regexp.MustCompile.
+func NewCounter(bucket string) *CounterHandle {
+	return &CounterHandle{bucket: bucket, name: mustResolveMetricName(bucket)}
+}
+
+// Name of the counter, as resolved by the process's NamePolicy
+func (h *CounterHandle) Name() string {
+	return h.name
+}
+
+// Increment the counter in the request's metrics. Works like the package-level
+// Increment, but only returns IllegalMetricName if the request's pipeline has its
+// own NamePolicy.
+func (h *CounterHandle) Increment(ctx context.Context) error {
+	rs, ok := lockStats(ctx)
+	if !ok {
+		return RequestMetricsNotInitted
+	}
+	defer rs.mu.Unlock()
+	return rs.incrementChecked(h.bucket, h.name, 0)
+}
+
+// IncrementSampled increments the counter at the given sample rate, like the
+// package-level IncrementSampled.
+func (h *CounterHandle) IncrementSampled(ctx context.Context, rate float64) error {
+	rs, ok := lockStats(ctx)
+	if !ok {
+		return RequestMetricsNotInitted
+	}
+	defer rs.mu.Unlock()
+	return rs.incrementChecked(h.bucket, h.name, rate)
+}
+
+// TimerHandle is a pre-validated timer bucket. Make one with NewTimer.
+type TimerHandle struct {
+	bucket string
+	name   string
+}
+
+// NewTimer returns a handle for the named timer bucket. Like NewCounter, it
+// panics if the name is illegal.
+func NewTimer(bucket string) *TimerHandle {
+	return &TimerHandle{bucket: bucket, name: mustResolveMetricName(bucket)}
+}
+
+// Name of the timer, as resolved by the process's NamePolicy
+func (h *TimerHandle) Name() string {
+	return h.name
+}
+
+// Start the timer in the request's metrics. Works like the package-level
+// StartTimer, but only returns IllegalMetricName if the request's pipeline has its
+// own NamePolicy.
+func (h *TimerHandle) Start(ctx context.Context) error {
+	rs, ok := lockStats(ctx)
+	if !ok {
+		return RequestMetricsNotInitted
+	}
+	defer rs.mu.Unlock()
+	return rs.startTimerChecked(h.bucket, h.name, 0)
+}
+
+// StartSampled starts the timer at the given sample rate, like the package-level
+// StartTimerSampled.
+func (h *TimerHandle) StartSampled(ctx context.Context, rate float64) error {
+	rs, ok := lockStats(ctx)
+	if !ok {
+		return RequestMetricsNotInitted
+	}
+	defer rs.mu.Unlock()
+	return rs.startTimerChecked(h.bucket, h.name, rate)
+}
+
+// Finish the timer in the request's metrics. Works like the package-level FinishTimer.
+func (h *TimerHandle) Finish(ctx context.Context) error {
+	rs, ok := lockStats(ctx)
+	if !ok {
+		return RequestMetricsNotInitted
+	}
+	defer rs.mu.Unlock()
+	return rs.FinishTimer(h.bucket)
+}
+
+func mustResolveMetricName(bucket string) string {
+	name, err := metricName(bucket)
+	if err != nil {
+		panic(fmt.Sprintf("stats: illegal metric name %q: %s", bucket, err))
+	}
+	return name
+}
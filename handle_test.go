@@ -0,0 +1,106 @@
+package stats
+
+import (
+	"context"
+	"testing"
+)
+
+func TestHandles(t *testing.T) {
+	hits := NewCounter("cache.hit")
+	if err := hits.Increment(context.Background()); err != RequestMetricsNotInitted {
+		t.Errorf("Expected error %s, got %v", RequestMetricsNotInitted, err)
+	}
+	ctx := requestContextUsingMetrics()
+	hits.Increment(ctx)
+	Increment(ctx, "cache.hit")
+	rs, _ := statsFromContext(ctx)
+	if c := rs.counters["cache.hit"]; c == nil || c.Data() != 2 {
+		t.Errorf("Handle and bucket name should share a counter, got %v", c)
+	}
+	timer := NewTimer("cache.lookup")
+	if err := timer.Finish(ctx); err != TimerNotStarted {
+		t.Errorf("Expected error %s, got %v", TimerNotStarted, err)
+	}
+	timer.Start(ctx)
+	if _, ok := rs.timers["cache.lookup"]; !ok {
+		t.Errorf("Timer handle didn't start a timer")
+	}
+}
+
+func TestHandleIllegalName(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected NewCounter to panic on an illegal name")
+		}
+	}()
+	NewCounter("illegal/char&")
+}
+
+func TestHandlesUsePipelineNamePolicy(t *testing.T) {
+	hits := NewCounter("cache.hit")
+	misses := NewCounter("cache.miss")
+	lookup := NewTimer("cache.lookup")
+	rs := acquireRequestStats()
+	rs.names = NamePolicyFunc(func(name string) (string, error) {
+		if name == "cache.miss" {
+			return "", IllegalMetricName
+		}
+		return "svc." + name, nil
+	})
+	ctx := statsToContext(context.Background(), rs)
+	defer releaseRequestStats(rs)
+
+	hits.Increment(ctx)
+	hits.Increment(ctx)
+	if c := rs.counters["cache.hit"]; c == nil || c.Name() != "svc.cache.hit" || c.Data() != 2 {
+		t.Errorf("Expected the handle to be named by the pipeline's policy, got %v", c)
+	}
+	if err := misses.Increment(ctx); err != IllegalMetricName {
+		t.Errorf("Expected the pipeline's policy to reject the handle, got %v", err)
+	}
+	lookup.Start(ctx)
+	if tm := rs.timers["cache.lookup"]; tm == nil || tm.Name() != "svc.cache.lookup" {
+		t.Errorf("Expected the timer handle to be named by the pipeline's policy, got %v", tm)
+	}
+	if hits.Name() != "cache.hit" {
+		t.Errorf("Handles keep the name the process's policy gave them, got %s", hits.Name())
+	}
+}
+
+func BenchmarkIncrement(b *testing.B) {
+	ctx := requestContextUsingMetrics()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Increment(ctx, "bench/counter")
+	}
+}
+
+func BenchmarkCounterHandle(b *testing.B) {
+	ctx := requestContextUsingMetrics()
+	h := NewCounter("bench/counter")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Increment(ctx)
+	}
+}
+
+// The first use of a bucket in a request is where the name checking happens,
+// so these two benchmarks start a fresh request on every iteration.
+func BenchmarkIncrementFirstUse(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ctx := requestContextUsingMetrics()
+		Increment(ctx, "bench/counter")
+	}
+}
+
+func BenchmarkCounterHandleFirstUse(b *testing.B) {
+	h := NewCounter("bench/counter")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ctx := requestContextUsingMetrics()
+		h.Increment(ctx)
+	}
+}
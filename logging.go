@@ -0,0 +1,132 @@
+package stats
+
+// Most errors in the metrics pipeline happen after the caller has moved on: sinks are
+// written to in the background, once a request is finished. Those errors go to an
+// ErrorHandler, and warnings (throttling, circuit breakers opening, cardinality
+// overflows and so on) go to a Logger. By default, errors are logged, and the Logger
+// is log/slog's default logger.
+//
+// Both can be set for the whole process, with SetLogger and SetErrorHandler, or for
+// one pipeline, with options to Metrics:
+//
+//	router.Use(stats.Metrics(sink, stats.WithErrorHandler(func(ctx context.Context, err error) {
+//	    if errors.Is(err, stats.CircuitOpen) {
+//	        ...
+//	    }
+//	})))
+//
+// Sink decorators that write in the background (the RateLimitedSink's deferred writes,
+// and SpillSink replays) aren't part of any one pipeline, and use the process's
+// Logger and ErrorHandler.
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+// Logger receives the stats package's log messages, formatted as by fmt.Sprintf.
+type Logger interface {
+	Errorf(ctx context.Context, format string, args ...interface{})
+	Warningf(ctx context.Context, format string, args ...interface{})
+}
+
+// An ErrorHandler is called with errors that couldn't be returned to a caller. The error
+// is a *PipelineError, which wraps the original.
+type ErrorHandler func(ctx context.Context, err error)
+
+// PipelineError is an error from the background parts of the metrics pipeline.
+type PipelineError struct {
+	Message string // What went wrong, as in "Error flushing metrics"
+	Err     error
+}
+
+func (e *PipelineError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Message, e.Err)
+}
+
+func (e *PipelineError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	defaultsMu sync.Mutex // serializes changes to defaults
+	defaults   atomic.Pointer[pipeline]
+)
+
+func init() {
+	defaults.Store(&pipeline{logger: SlogLogger(nil)})
+}
+
+// SetLogger sets the Logger for pipelines that don't have their own. A nil Logger
+// restores the default, which logs to slog.Default().
+func SetLogger(l Logger) {
+	if l == nil {
+		l = SlogLogger(nil)
+	}
+	defaultsMu.Lock()
+	defer defaultsMu.Unlock()
+	defaults.Store(&pipeline{logger: l, onError: defaults.Load().onError})
+}
+
+// SetErrorHandler sets the ErrorHandler for pipelines that don't have their own. A nil
+// ErrorHandler restores the default, which logs errors.
+func SetErrorHandler(h ErrorHandler) {
+	defaultsMu.Lock()
+	defer defaultsMu.Unlock()
+	defaults.Store(&pipeline{logger: defaults.Load().logger, onError: h})
+}
+
+func loggerFor(ctx context.Context) Logger {
+	if p, ok := pipelineFromContext(ctx); ok && p.logger != nil {
+		return p.logger
+	}
+	return defaults.Load().logger
+}
+
+// warnf logs a warning to the ctx's pipeline's Logger
+func warnf(ctx context.Context, format string, args ...interface{}) {
+	loggerFor(ctx).Warningf(ctx, format, args...)
+}
+
+// reportError sends err, with a message formatted from the rest of the arguments, to
+// the ctx's pipeline's ErrorHandler, or logs it if there isn't one.
+func reportError(ctx context.Context, err error, format string, args ...interface{}) {
+	pe := &PipelineError{Message: fmt.Sprintf(format, args...), Err: err}
+	handler := defaults.Load().onError
+	if p, ok := pipelineFromContext(ctx); ok && p.onError != nil {
+		handler = p.onError
+	}
+	if handler != nil {
+		handler(ctx, pe)
+		return
+	}
+	loggerFor(ctx).Errorf(ctx, "%s", pe)
+}
+
+// SlogLogger adapts a *slog.Logger to Logger. A nil *slog.Logger means slog.Default(),
+// as of each message.
+func SlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (s slogLogger) logger() *slog.Logger {
+	if s.l == nil {
+		return slog.Default()
+	}
+	return s.l
+}
+
+func (s slogLogger) Errorf(ctx context.Context, format string, args ...interface{}) {
+	s.logger().ErrorContext(ctx, fmt.Sprintf(format, args...))
+}
+
+func (s slogLogger) Warningf(ctx context.Context, format string, args ...interface{}) {
+	s.logger().WarnContext(ctx, fmt.Sprintf(format, args...))
+}
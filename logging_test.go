@@ -0,0 +1,108 @@
+package stats
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPipelineErrorHandler(t *testing.T) {
+	errs := make(chan error, 1)
+	handler := Metrics(failingSink{}, WithErrorHandler(func(ctx context.Context, err error) {
+		errs <- err
+	}))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Increment(r.Context(), "test/counter")
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	cancel()
+
+	select {
+	case err := <-errs:
+		var pe *PipelineError
+		if !errors.As(err, &pe) || pe.Message != "Error flushing metrics" || pe.Err.Error() != "failed" {
+			t.Errorf("Expected a PipelineError for the flush, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Error handler wasn't called")
+	}
+}
+
+func TestPipelineLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := SlogLogger(slog.New(slog.NewTextHandler(&buf, nil)))
+	ctx := pipelineToContext(context.Background(), newPipeline([]Option{WithLogger(logger)}))
+
+	warnf(ctx, "Something is %s", "up")
+	reportError(ctx, errors.New("failed"), "Error writing to %s", "sink")
+	out := buf.String()
+	if !strings.Contains(out, `level=WARN msg="Something is up"`) {
+		t.Errorf("Warning wasn't logged, got %q", out)
+	}
+	if !strings.Contains(out, `level=ERROR msg="Error writing to sink: failed"`) {
+		t.Errorf("Error wasn't logged, got %q", out)
+	}
+
+	// a context that has been handed off to the background keeps its pipeline
+	buf.Reset()
+	warnf(withPipelineOf(context.Background(), ctx), "Still here")
+	if !strings.Contains(buf.String(), "Still here") {
+		t.Errorf("Background context lost its pipeline")
+	}
+}
+
+func TestDefaultErrorHandler(t *testing.T) {
+	var got error
+	SetErrorHandler(func(ctx context.Context, err error) { got = err })
+	defer SetErrorHandler(nil)
+
+	reportError(context.Background(), CircuitOpen, "Error writing metrics")
+	if !errors.Is(got, CircuitOpen) {
+		t.Errorf("Expected the default handler to get CircuitOpen, got %v", got)
+	}
+
+	// a pipeline's own handler takes precedence
+	got = nil
+	var own error
+	ctx := pipelineToContext(context.Background(), newPipeline([]Option{WithErrorHandler(func(ctx context.Context, err error) { own = err })}))
+	reportError(ctx, CircuitOpen, "Error writing metrics")
+	if got != nil || own == nil {
+		t.Errorf("Expected the pipeline's handler to be used, got %v and %v", got, own)
+	}
+}
+
+func TestSetDefaultsConcurrently(t *testing.T) {
+	defer SetLogger(nil)
+	defer SetErrorHandler(nil)
+	for i := 0; i < 100; i++ {
+		var called bool
+		logger := SlogLogger(slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil)))
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			SetLogger(logger)
+		}()
+		go func() {
+			defer wg.Done()
+			SetErrorHandler(func(ctx context.Context, err error) { called = true })
+		}()
+		wg.Wait()
+		if loggerFor(context.Background()) != logger {
+			t.Fatalf("Lost the logger on try %d", i)
+		}
+		reportError(context.Background(), CircuitOpen, "Error writing metrics")
+		if !called {
+			t.Fatalf("Lost the error handler on try %d", i)
+		}
+		SetLogger(nil)
+		SetErrorHandler(nil)
+	}
+}
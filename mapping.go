@@ -0,0 +1,209 @@
+package stats
+
+// Mappings split hierarchical metric names into a name plus tags, for moving from
+// dotted (Graphite-style) names to a tag-based backend. They work like the mapping
+// config of the Prometheus statsd_exporter:
+//
+//	mappings:
+//	  - match: api.*.*.latency          # glob; each * matches one name segment
+//	    name: api.latency
+//	    tags: {resource: $1, method: $2}
+//	  - match: '^jobs\.(\w+)\.(ok|failed)$'
+//	    match_type: regex
+//	    name: jobs.$2
+//	    tags: {job: $1}
+//	  - match: debug.*
+//	    drop: true
+//
+// With those mappings, api.users.get.latency is written as api.latency with the tags
+// resource=users and method=get. In globs, dots and slashes both match either kind of
+// separator, so the first mapping also handles api/users/get/latency. Mappings are
+// tried in order and the first match wins; names that don't match any mapping are
+// passed through unchanged.
+//
+// Apply mappings with the MapNames sink decorator.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var UnknownMatchType = errors.New("Unknown mapping match type")
+
+// Match types for mappings
+const (
+	MatchGlob  = "glob"
+	MatchRegex = "regex"
+)
+
+// Mapped names are cached, up to this many, after which the cache starts over
+const maxMappingCache = 10000
+
+// Mapping is a single name-to-tags mapping. See the example at the top of mapping.go.
+type Mapping struct {
+	Match     string            `json:"match" yaml:"match"`
+	MatchType string            `json:"match_type,omitempty" yaml:"match_type,omitempty"` // glob (default) or regex
+	Name      string            `json:"name,omitempty" yaml:"name,omitempty"`             // New name; can use captures
+	Tags      map[string]string `json:"tags,omitempty" yaml:"tags,omitempty"`             // Tags to add; values can use captures
+	Drop      bool              `json:"drop,omitempty" yaml:"drop,omitempty"`             // Don't send matching metrics
+}
+
+// MappingConfig is the file form of a list of mappings.
+type MappingConfig struct {
+	Mappings []Mapping `json:"mappings" yaml:"mappings"`
+}
+
+// Mapper applies a list of compiled mappings. Mappers are safe for concurrent use.
+type Mapper struct {
+	mappings []compiledMapping
+	mu       sync.Mutex
+	cache    map[string]mapResult
+}
+
+type compiledMapping struct {
+	Mapping
+	re *regexp.Regexp
+}
+
+type mapResult struct {
+	name string
+	tags Tags
+	ok   bool
+}
+
+// Compile the config into a Mapper.
+func (mc MappingConfig) Compile() (*Mapper, error) {
+	m := &Mapper{cache: make(map[string]mapResult)}
+	for i, mapping := range mc.Mappings {
+		var expr string
+		switch mapping.MatchType {
+		case "", MatchGlob:
+			expr = globToRegexp(mapping.Match)
+		case MatchRegex:
+			expr = mapping.Match
+		default:
+			return nil, fmt.Errorf("mapping %d: %w: %q", i, UnknownMatchType, mapping.MatchType)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("mapping %d: %w", i, err)
+		}
+		m.mappings = append(m.mappings, compiledMapping{Mapping: mapping, re: re})
+	}
+	return m, nil
+}
+
+// globToRegexp turns a glob into an anchored expression where each * captures one
+// segment, and each separator matches either a dot or a slash
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteByte('^')
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(`([^./]+)`)
+		case '.', '/':
+			b.WriteString(`[./]`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteByte('$')
+	return b.String()
+}
+
+// ParseMappings parses and compiles a mappings document (YAML or JSON).
+func ParseMappings(data []byte) (*Mapper, error) {
+	var mc MappingConfig
+	if err := yaml.UnmarshalStrict(data, &mc); err != nil {
+		return nil, err
+	}
+	return mc.Compile()
+}
+
+// LoadMappings reads mappings from a file. Files ending in .json are parsed as JSON;
+// anything else is parsed as YAML.
+func LoadMappings(path string) (*Mapper, error) {
+	var mc MappingConfig
+	if err := loadConfig(path, &mc); err != nil {
+		return nil, err
+	}
+	return mc.Compile()
+}
+
+// Map a metric name. The tags from the matching mapping are merged with the tags
+// passed in (which aren't modified). If the metric should be dropped, ok is false.
+func (m *Mapper) Map(name string, tags Tags) (string, Tags, bool) {
+	res := m.lookup(name)
+	if !res.ok {
+		return "", nil, false
+	} else if len(res.tags) > 0 {
+		tags = tags.With(res.tags)
+	}
+	return res.name, tags, true
+}
+
+func (m *Mapper) lookup(name string) mapResult {
+	m.mu.Lock()
+	res, ok := m.cache[name]
+	m.mu.Unlock()
+	if ok {
+		return res
+	}
+	res = m.match(name)
+	m.mu.Lock()
+	if len(m.cache) >= maxMappingCache {
+		m.cache = make(map[string]mapResult)
+	}
+	m.cache[name] = res
+	m.mu.Unlock()
+	return res
+}
+
+func (m *Mapper) match(name string) mapResult {
+	for _, mapping := range m.mappings {
+		match := mapping.re.FindStringSubmatchIndex(name)
+		if match == nil {
+			continue
+		} else if mapping.Drop {
+			return mapResult{}
+		}
+		res := mapResult{name: name, ok: true}
+		if mapping.Name != "" {
+			res.name = string(mapping.re.ExpandString(nil, mapping.Name, name, match))
+		}
+		if len(mapping.Tags) > 0 {
+			res.tags = make(Tags, len(mapping.Tags))
+			for k, v := range mapping.Tags {
+				res.tags[k] = string(mapping.re.ExpandString(nil, v, name, match))
+			}
+		}
+		return res
+	}
+	return mapResult{name: name, ok: true}
+}
+
+// MapNames wraps sink so that every metric written to it is passed through the mapper.
+// Mapped names are checked with the NamePolicy, and metrics whose names it rejects are
+// dropped (and reported).
+func MapNames(sink Sink, mapper *Mapper) Sink {
+	return newTransformSink(sink, func(ctx context.Context, m Metric) []Metric {
+		name, tags, ok := mapper.Map(m.Name(), tagsOf(m))
+		if !ok {
+			return nil
+		} else if name != m.Name() {
+			checked, err := checkName(namePolicyFor(ctx), name)
+			if err != nil {
+				reportError(ctx, err, "Dropping metric %s, which was mapped to %q", m.Name(), name)
+				return nil
+			}
+			name = checked
+		}
+		return []Metric{withIdentity(m, name, tags)}
+	})
+}
@@ -0,0 +1,92 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+const testMappings = `
+mappings:
+  - match: api.*.*.latency
+    name: api.latency
+    tags: {resource: $1, method: $2}
+  - match: '^jobs\.(\w+)\.(ok|failed)$'
+    match_type: regex
+    name: jobs.$2
+    tags: {job: $1}
+  - match: debug.*
+    drop: true
+`
+
+var mappingChecks = []struct {
+	name     string
+	expected string
+	tags     string
+	ok       bool
+}{
+	{"api.users.get.latency", "api.latency", "method=get,resource=users", true},
+	{"api/users/get/latency", "api.latency", "method=get,resource=users", true},
+	{"api.users.get.extra.latency", "api.users.get.extra.latency", "", true},
+	{"jobs.resize.failed", "jobs.failed", "job=resize", true},
+	{"debug.dump", "", "", false},
+	{"unmapped/name", "unmapped/name", "", true},
+}
+
+func TestMapper(t *testing.T) {
+	mapper, err := ParseMappings([]byte(testMappings))
+	if err != nil {
+		t.Fatalf("Error parsing mappings: %s", err)
+	}
+	for i := 0; i < 2; i++ { // second time through comes from the cache
+		for _, test := range mappingChecks {
+			name, tags, ok := mapper.Map(test.name, nil)
+			if ok != test.ok || name != test.expected || tags.String() != test.tags {
+				t.Errorf("Mapping %s: expected (%s, %s, %t), got (%s, %s, %t)",
+					test.name, test.expected, test.tags, test.ok, name, tags, ok)
+			}
+		}
+	}
+	if _, err := ParseMappings([]byte(`{"mappings": [{"match": "x", "match_type": "fuzzy"}]}`)); err == nil {
+		t.Errorf("Expected an error for an unknown match type")
+	}
+}
+
+func TestMapNames(t *testing.T) {
+	mapper, _ := ParseMappings([]byte(testMappings))
+	sink := &recordingSink{}
+	timer := makeTimer("api.users.get.latency")
+	timer.Finish()
+	MapNames(sink, mapper).WriteTimers(context.Background(), timer)
+	if len(sink.timers) != 1 {
+		t.Fatalf("Expected 1 timer, got %d", len(sink.timers))
+	}
+	if mapped := sink.timers[0]; mapped.Name() != "api.latency" || mapped.Tags()["resource"] != "users" {
+		t.Errorf("Expected mapped timer, got %s %s", mapped.Name(), mapped.Tags())
+	} else if mapped.Duration() != timer.Duration() {
+		t.Errorf("Mapping should keep the timer's data")
+	}
+}
+
+func TestMapNamesIllegalName(t *testing.T) {
+	errs := make(chan error, 1)
+	SetErrorHandler(func(ctx context.Context, err error) { errs <- err })
+	defer SetErrorHandler(nil)
+	mapper, err := ParseMappings([]byte(`{"mappings": [{"match": "api.*", "name": "$1 and more"}]}`))
+	if err != nil {
+		t.Fatalf("Error parsing mappings: %s", err)
+	}
+	sink := &recordingSink{}
+	MapNames(sink, mapper).WriteCounters(context.Background(), makeCounter("api.users"), makeCounter("web.home"))
+	if len(sink.counters) != 1 || sink.counters[0].Name() != "web.home" {
+		t.Errorf("Expected the illegally mapped metric to be dropped, got %v", sink.counters)
+	}
+	select {
+	case err := <-errs:
+		if !errors.Is(err, IllegalMetricName) {
+			t.Errorf("Expected %s, got %v", IllegalMetricName, err)
+		}
+	default:
+		t.Errorf("Expected the dropped metric to be reported")
+	}
+}
@@ -19,6 +19,7 @@ package stats
 import (
 	"errors"
 	"fmt"
+	"math"
 	"regexp"
 	"time"
 )
@@ -48,26 +49,84 @@ type Metric interface {
 type metric struct {
 	name string
 	data int
+	tags Tags
+	rate float64 // 0 when the metric wasn't sampled
 }
 
 func (m *metric) Name() string {
 	return m.name
 }
 
+// Tags on the metric, if any. See Tags.
+func (m *metric) Tags() Tags {
+	return m.tags
+}
+
 func (m *metric) Data() int { // this should maybe be an int64
 	return m.data
 }
 
+// SampleRate is the fraction of events that were recorded in the metric: 1 unless
+// the metric was sampled. See sampling.go.
+func (m *metric) SampleRate() float64 {
+	if m.rate <= 0 || m.rate > 1 {
+		return 1
+	}
+	return m.rate
+}
+
 // Counter metric. This interface is public primarily for access by Sink implementations.
 // It is not used directly by stats event producers.
 type Counter struct {
-	*metric
+	metric
+	sampler sampler
 }
 
 func (c *Counter) Increment() {
 	c.data++
 }
 
+// Estimate of the true count: the recorded count scaled up by the sample rate.
+func (c *Counter) Estimate() int {
+	return int(math.Round(c.estimate()))
+}
+
+func (c *Counter) estimate() float64 {
+	return float64(c.data) / c.SampleRate()
+}
+
+// incrementSampled records an increment that was sampled at rate, keeping the
+// counter's rate such that the estimate is the sum of 1/rate over its increments
+func (c *Counter) incrementSampled(rate float64) {
+	if rate >= 1 && c.rate == 0 {
+		c.data++
+		return
+	}
+	est := c.estimate() + 1/rate
+	c.data++
+	c.rate = float64(c.data) / est
+}
+
+// sample an increment at rate, or at the counter's own rate if rate is 0
+func (c *Counter) sample(rate float64) {
+	if rate <= 0 {
+		rate = c.sampler.rate()
+	}
+	if sampled(rate) {
+		c.incrementSampled(rate)
+	}
+}
+
+// merge returns a new counter with the sum of c and other, keeping the estimate exact
+func (c *Counter) merge(other *Counter) *Counter {
+	merged := *c
+	merged.data += other.data
+	if c.rate != 0 || other.rate != 0 {
+		merged.rate = float64(merged.data) / (c.estimate() + other.estimate())
+	}
+	return &merged
+}
+
 func (c *Counter) Decrement() {
 	c.data--
 }
@@ -75,8 +134,9 @@ func (c *Counter) Decrement() {
 // Timer metric. This interface is public primarily for access by Sink implementations.
 // It is not used directly by stats event producers.
 type Timer struct {
-	*metric
-	startTime int64
+	metric
+	startTime  int64
+	sampledOut bool // the timer runs, but isn't sent
 }
 
 // Nanoseconds
@@ -97,24 +157,82 @@ func (t *Timer) String() string {
 	return fmt.Sprintf("T%s: %s", t.name, time.Duration(int64(t.data)))
 }
 
-func newCounter(bucket string) (*Counter, error) {
-	if err := checkMetricName(bucket); err != nil {
-		return nil, err
+// Gauge metric: the last value set for the bucket in a request. Gauges are only
+// written to sinks that implement GaugeWriter.
+type Gauge struct {
+	metric
+}
+
+func (g *Gauge) Value() int {
+	return g.data
+}
+
+func (g *Gauge) Set(v int) {
+	g.data = v
+}
+
+// Histogram metric: a set of durations observed in a request, for sinks that store
+// distributions (see HistogramWriter). Data is the number of observations. Sinks that
+// support bucketed distributions can find the bucket bounds for a declared histogram
+// with DefaultRegistry.Lookup.
+type Histogram struct {
+	metric
+	observations []time.Duration
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	h.observations = append(h.observations, d)
+	h.data++
+}
+
+// Observations in the order they were made. The slice must not be modified.
+func (h *Histogram) Observations() []time.Duration {
+	return h.observations
+}
+
+// timers converts each observation into a finished Timer, for sinks that can't
+// store histograms
+func (h *Histogram) timers() []*Timer {
+	timers := make([]*Timer, len(h.observations))
+	for i, d := range h.observations {
+		timers[i] = &Timer{metric: metric{name: h.name, data: int(d), tags: h.tags}}
 	}
-	c := &Counter{metric: &metric{name: bucket, data: 0}}
-	return c, nil
+	return timers
 }
 
-func newTimer(bucket string) (*Timer, error) {
-	if err := checkMetricName(bucket); err != nil {
-		return nil, err
+// resolveMetricName checks the bucket against the NamePolicy and the DefaultRegistry,
+// and returns the name the metric should be recorded as.
+func resolveMetricName(policy NamePolicy, bucket string, kind Kind) (string, error) {
+	name, err := checkName(policy, bucket)
+	if err != nil {
+		return "", err
+	} else if err := DefaultRegistry.Check(name, kind); err != nil {
+		return "", err
 	}
-	t := &Timer{metric: &metric{name: bucket}, startTime: time.Now().UnixNano()}
-	return t, nil
+	return name, nil
+}
+
+// makeCounter skips name validation, for names that are known to be legal
+func makeCounter(name string) *Counter {
+	return &Counter{metric: metric{name: name, data: 0}}
+}
+
+// makeTimer skips name validation, for names that are known to be legal
+func makeTimer(name string) *Timer {
+	return &Timer{metric: metric{name: name}, startTime: time.Now().UnixNano()}
+}
+
+func makeGauge(name string) *Gauge {
+	return &Gauge{metric: metric{name: name}}
+}
+
+func makeHistogram(name string) *Histogram {
+	return &Histogram{metric: metric{name: name}}
 }
 
 var ccds = regexp.MustCompile(`[./]{2,}?`)
 
+// checkMetricName applies the rules of the StrictNames policy
 func checkMetricName(n string) error {
 	if !legalMetricName.MatchString(n) {
 		return IllegalMetricName
@@ -125,11 +243,14 @@ func checkMetricName(n string) error {
 }
 
 func (t *Timer) Finish() error {
+	return t.finishAt(time.Now())
+}
+
+func (t *Timer) finishAt(now time.Time) error {
 	if !t.Started() {
 		return TimerNotStarted
 	} else if !t.Finished() {
-		now := time.Now().UnixNano()
-		t.data = int(now - t.startTime)
+		t.data = int(now.UnixNano() - t.startTime)
 	}
 	return nil // second+ finish will noop
 }
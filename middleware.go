@@ -4,16 +4,19 @@ package stats
 
 import (
 	"context"
-	"github.com/efixler/logger"
 	"github.com/efixler/multierror"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type statsContextKey string
 type statsSinkKey string
 
-var (
+// Keys are constants so that boxing them for context lookups doesn't allocate
+const (
 	requestStatsKey = statsContextKey("requestStats")
 	sinkKey         = statsSinkKey("statsSink")
 )
@@ -21,11 +24,17 @@ var (
 // This is the middleware call to set up metrics for a request, probably in conjunction with Gorilla mux,
 // as in:
 //		router.Use(Metrics(sink))
-// where sink implements the Sink interface.
-func Metrics(sink Sink) func(http.Handler) http.Handler {
+// where sink implements the Sink interface. Options configure the pipeline; see
+// options.go.
+func Metrics(sink Sink, opts ...Option) func(http.Handler) http.Handler {
+	p := newPipeline(opts)
+	if sink != nil {
+		sink = p.decorate(sink)
+	}
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			r = r.WithContext(initRequestContext(r.Context(), newRequestStats(), sink))
+			ctx := pipelineToContext(r.Context(), p)
+			r = r.WithContext(initRequestContext(ctx, acquireRequestStats(), sink))
 			next.ServeHTTP(w, r)
 		})
 	}
@@ -33,9 +42,17 @@ func Metrics(sink Sink) func(http.Handler) http.Handler {
 
 func initRequestContext(ctx context.Context, rc *requestStats, sink Sink) context.Context {
 	ctx = statsToContext(ctx, rc)
+	rc.ctx = ctx
+	p, _ := pipelineFromContext(ctx)
+	p.configure(rc)
 	if sink != nil {
 		rc.eventChannel = openMetricsChannel(ctx, sink)
+		rc.flushing = true
 		ctx = context.WithValue(ctx, sinkKey, sink)
+	} else if p != nil && len(p.hooks) > 0 {
+		// nothing to send, but the hooks still need to see the metrics
+		waitForRequestDone(ctx, nil)
+		rc.flushing = true
 	}
 	return ctx
 }
@@ -56,7 +73,7 @@ func TimeRequests(next http.Handler) http.Handler {
 //
 //
 // Metric buckets are created on demand. Metric names can have alphanumeric characters,
-// slashes, underscores, and dots.
+// slashes, underscores, and dots. (This is the default StrictNames policy; see SetNamePolicy.)
 //
 //
 //  func addUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -64,24 +81,28 @@ func TimeRequests(next http.Handler) http.Handler {
 //    err := stats.Increment(r.Context(), "add_user")
 //    ...
 //  }
-// Errors returned here will generally be IllegalMetricName or RequestMetricsNotInitted.
+// Errors returned here will generally be IllegalMetricName or RequestMetricsNotInitted,
+// or UndeclaredMetric/WrongMetricKind when the DefaultRegistry is strict.
 // Errors relating to the backend will not be reported here, as events
 func Increment(ctx context.Context, bucket string) error {
-	ctxMetrics, ok := statsFromContext(ctx)
+	ctxMetrics, ok := lockStats(ctx)
 	if !ok {
 		return RequestMetricsNotInitted
 	}
-	c, ok := ctxMetrics.counters[bucket]
+	defer ctxMetrics.mu.Unlock()
+	return ctxMetrics.Increment(bucket)
+}
+
+// IncrementSampled is Increment for an event sampled at rate (0 < rate <= 1): the
+// increment is recorded with probability rate, and the counter carries the rate so
+// that it can be scaled back up. See sampling.go.
+func IncrementSampled(ctx context.Context, bucket string, rate float64) error {
+	ctxMetrics, ok := lockStats(ctx)
 	if !ok {
-		var err error
-		c, err = newCounter(bucket)
-		if err != nil {
-			return err
-		}
-		ctxMetrics.counters[bucket] = c //could consider a lock here, but in request scope contention seems unlikely
+		return RequestMetricsNotInitted
 	}
-	c.Increment()
-	return nil
+	defer ctxMetrics.mu.Unlock()
+	return ctxMetrics.increment(bucket, rate)
 }
 
 // Starts a timer with the named bucket. Named buckets are created on demand, and can contain alphanumeric
@@ -94,57 +115,76 @@ func Increment(ctx context.Context, bucket string) error {
 //      err := stats.FinishTimer(r.Context(), timerName)
 //  }
 //
-// Errors returned here will generally be IllegalMetricName or RequestMetricsNotInitted.
+// Errors returned here will generally be IllegalMetricName or RequestMetricsNotInitted,
+// or UndeclaredMetric/WrongMetricKind when the DefaultRegistry is strict.
 func StartTimer(ctx context.Context, bucket string) error {
-	ctxMetrics, ok := statsFromContext(ctx)
+	ctxMetrics, ok := lockStats(ctx)
 	if !ok {
 		return RequestMetricsNotInitted
 	}
-	if t, err := newTimer(bucket); err != nil {
-		return err
-	} else {
-		ctxMetrics.timers[bucket] = t
-		return nil
-	}
+	defer ctxMetrics.mu.Unlock()
+	return ctxMetrics.StartTimer(bucket)
+}
 
+// StartTimerSampled is StartTimer for a timer sampled at rate (0 < rate <= 1). A timer
+// that isn't sampled still has to be finished, but it isn't sent. See sampling.go.
+func StartTimerSampled(ctx context.Context, bucket string, rate float64) error {
+	ctxMetrics, ok := lockStats(ctx)
+	if !ok {
+		return RequestMetricsNotInitted
+	}
+	defer ctxMetrics.mu.Unlock()
+	return ctxMetrics.startTimer(bucket, rate)
 }
 
 // Finish the timer specified by bucket.
 // The finished  timer will be forwarded to the Sink, if one has been set up.
 func FinishTimer(ctx context.Context, bucket string) error {
-	ctxMetrics, ok := statsFromContext(ctx)
+	ctxMetrics, ok := lockStats(ctx)
 	if !ok {
 		return RequestMetricsNotInitted
 	}
-	t, ok := ctxMetrics.timers[bucket]
+	defer ctxMetrics.mu.Unlock()
+	return ctxMetrics.FinishTimer(bucket)
+}
+
+// Set the gauge with the named bucket. If a gauge is set more than once in a request,
+// the last value is the one sent. Gauges are only written to sinks that implement
+// GaugeWriter; other sinks drop them.
+func SetGauge(ctx context.Context, bucket string, value int) error {
+	ctxMetrics, ok := lockStats(ctx)
 	if !ok {
-		return TimerNotStarted
-	}
-	err := t.Finish()
-	if err != nil {
-		return err
+		return RequestMetricsNotInitted
 	}
-	if err := ctxMetrics.sendTimer(bucket); err != nil {
-		logger.Context.Warningf(ctx, "Error pushing finished timer %s into event stream: %s", bucket, err)
+	defer ctxMetrics.mu.Unlock()
+	return ctxMetrics.SetGauge(bucket, value)
+}
+
+// Add a duration to the histogram with the named bucket. All of the observations made
+// in a request are sent together when the request finishes. Sinks that don't implement
+// HistogramWriter receive each observation as a Timer.
+func Observe(ctx context.Context, bucket string, d time.Duration) error {
+	ctxMetrics, ok := lockStats(ctx)
+	if !ok {
+		return RequestMetricsNotInitted
 	}
-	return nil
+	defer ctxMetrics.mu.Unlock()
+	return ctxMetrics.Observe(bucket, d)
 }
 
 ////// end of public APIs
 
 // flushAll will ensure that all timers are finished and then send them on.
 // In-progress errors do not stop execution. They are collected and returned in the error
-// (which is a MultiError)
-func flushAll(ctx context.Context) error {
+// (which is a MultiError). rs.mu must be held.
+func (ctxMetrics *requestStats) flushAll() error {
 	me := make(multierror.MultiError, 0)
-	// just in case.
-
-	ctxMetrics, ok := statsFromContext(ctx)
-	if !ok {
-		return RequestMetricsNotInitted
-	}
+	now := ctxMetrics.now()
 	for _, timer := range ctxMetrics.timers {
-		if err := timer.Finish(); err != nil {
+		if timer.Started() && !timer.Finished() {
+			self.unfinishedTimers.Add(1)
+		}
+		if err := timer.finishAt(now); err != nil {
 			me = append(me, err)
 		}
 	}
@@ -161,29 +201,287 @@ func flushAll(ctx context.Context) error {
 // probably indicates shitty code anyway)
 
 type requestStats struct {
+	mu           sync.Mutex    // guards everything below, from the request's first use until it's released
+	gen          atomic.Uint64 // see statsRef; only changed with mu held
+	ctx          context.Context
 	counters     map[string]*Counter
 	timers       map[string]*Timer
+	gauges       map[string]*Gauge
+	histograms   map[string]*Histogram
+	finished     map[string]time.Duration // timers that have been finished and sent
 	eventChannel chan<- Metric
+	flushMode    FlushMode
+	clock        func() time.Time // nil is time.Now
+	names        NamePolicy       // nil is CurrentNamePolicy()
+	hooks        []FlushHook      // for this request only; see onFlush
+	flushing     bool             // something is waiting to flush the request
+	hooksRun     bool             // the flush has taken the hooks
+}
+
+// requestStats are recycled once a request's metrics are flushed, so the context
+// stores the generation along with the pointer. A context whose generation is stale
+// belongs to a finished request, and is treated as though it has no metrics. Since a
+// goroutine can outlive its request, the generation is checked with the requestStats
+// locked (see lockStats), and it's changed under the same lock when they're released.
+//
+// A statsRef is also the request's Recorder (see FromContext), so that a Recorder
+// kept past the end of its request can't write into the next one.
+type statsRef struct {
+	rs  *requestStats
+	gen uint64
 }
 
 func statsToContext(ctx context.Context, rs *requestStats) context.Context {
-	ctx = context.WithValue(ctx, requestStatsKey, rs)
+	ctx = context.WithValue(ctx, requestStatsKey, &statsRef{rs: rs, gen: rs.gen.Load()})
 	return ctx
 }
 
-func statsFromContext(ctx context.Context) (*requestStats, bool) {
-	ctxMetrics, ok := ctx.Value(requestStatsKey).(*requestStats)
-	return ctxMetrics, ok
+// lockStats returns the ctx's requestStats, locked, if they still belong to the ctx's
+// request. The caller has to unlock them.
+func lockStats(ctx context.Context) (*requestStats, bool) {
+	ref, ok := ctx.Value(requestStatsKey).(*statsRef)
+	if !ok {
+		return nil, false
+	}
+	return ref.lock()
+}
+
+// hasStats is true if the ctx's request has metrics. By the time the caller looks at
+// them they may be gone, so they still have to be read with lockStats.
+func hasStats(ctx context.Context) bool {
+	ref, ok := ctx.Value(requestStatsKey).(*statsRef)
+	return ok && ref.live()
+}
+
+// live is true if the requestStats still belong to the ref's request
+func (ref *statsRef) live() bool {
+	return ref.gen == ref.rs.gen.Load()
+}
+
+// lock the requestStats, if they still belong to the ref's request
+func (ref *statsRef) lock() (*requestStats, bool) {
+	ref.rs.mu.Lock()
+	if ref.gen != ref.rs.gen.Load() {
+		ref.rs.mu.Unlock()
+		return nil, false
+	}
+	return ref.rs, true
+}
+
+func (ref *statsRef) Increment(bucket string) error {
+	rs, ok := ref.lock()
+	if !ok {
+		return RequestMetricsNotInitted
+	}
+	defer rs.mu.Unlock()
+	return rs.Increment(bucket)
+}
+
+func (ref *statsRef) StartTimer(bucket string) error {
+	rs, ok := ref.lock()
+	if !ok {
+		return RequestMetricsNotInitted
+	}
+	defer rs.mu.Unlock()
+	return rs.StartTimer(bucket)
+}
+
+func (ref *statsRef) FinishTimer(bucket string) error {
+	rs, ok := ref.lock()
+	if !ok {
+		return RequestMetricsNotInitted
+	}
+	defer rs.mu.Unlock()
+	return rs.FinishTimer(bucket)
+}
+
+// Increment implements Recorder. See the package-level Increment for details.
+func (rs *requestStats) Increment(bucket string) error {
+	return rs.increment(bucket, 0)
+}
+
+// increment at the given sample rate, or at the bucket's own rate if rate is 0
+func (rs *requestStats) increment(bucket string, rate float64) error {
+	c, ok := rs.counters[bucket]
+	if !ok {
+		name, err := resolveMetricName(rs.namePolicy(), bucket, KindCounter)
+		if err != nil {
+			return err
+		}
+		c = rs.addCounter(bucket, name)
+	}
+	c.sample(rate)
+	return nil
+}
+
+// incrementChecked is increment for buckets whose names have already been resolved
+// by the process's NamePolicy. Buckets are always keyed by the name the caller used.
+func (rs *requestStats) incrementChecked(bucket, name string, rate float64) error {
+	c, ok := rs.counters[bucket]
+	if !ok {
+		name, err := rs.checkedName(bucket, name, KindCounter)
+		if err != nil {
+			return err
+		}
+		c = rs.addCounter(bucket, name)
+	}
+	c.sample(rate)
+	return nil
+}
+
+// Counters beyond the cardinality limits all share the overflow bucket
+func (rs *requestStats) addCounter(bucket, name string) *Counter {
+	if name = rs.admit(name); name == OverflowName {
+		if c, ok := rs.counters[OverflowName]; ok {
+			return c
+		}
+		bucket = OverflowName
+	}
+	c := makeCounter(name)
+	c.sampler = samplerFor(bucket)
+	rs.counters[bucket] = c
+	return c
+}
+
+// StartTimer implements Recorder. See the package-level StartTimer for details.
+func (rs *requestStats) StartTimer(bucket string) error {
+	return rs.startTimer(bucket, 0)
+}
+
+// startTimer at the given sample rate, or at the bucket's own rate if rate is 0
+func (rs *requestStats) startTimer(bucket string, rate float64) error {
+	name, err := resolveMetricName(rs.namePolicy(), bucket, KindTimer)
+	if err != nil {
+		return err
+	}
+	rs.addTimer(bucket, name, rate)
+	return nil
+}
+
+// startTimerChecked is startTimer for buckets whose names have already been resolved
+// by the process's NamePolicy
+func (rs *requestStats) startTimerChecked(bucket, name string, rate float64) error {
+	name, err := rs.checkedName(bucket, name, KindTimer)
+	if err != nil {
+		return err
+	}
+	rs.addTimer(bucket, name, rate)
+	return nil
+}
+
+// checkedName is the name for a bucket that was resolved ahead of time as name. If the
+// request's pipeline has its own NamePolicy, the bucket is resolved again with that.
+func (rs *requestStats) checkedName(bucket, name string, kind Kind) (string, error) {
+	if rs.names != nil {
+		return resolveMetricName(rs.names, bucket, kind)
+	}
+	return name, DefaultRegistry.Check(name, kind)
+}
+
+// Timers beyond the cardinality limits are named OverflowName, but are still kept
+// under their own bucket so that they can be finished. A restarted timer keeps the
+// name it was admitted with.
+//
+// A timer that's still in the bucket hasn't been handed to the sink (see sendTimer),
+// so restarting it reuses it rather than allocating a new one.
+func (rs *requestStats) addTimer(bucket, name string, rate float64) {
+	t, ok := rs.timers[bucket]
+	if ok {
+		*t = Timer{metric: metric{name: t.name}}
+	} else {
+		t = &Timer{metric: metric{name: rs.admit(name)}}
+	}
+	t.startTime = rs.now().UnixNano()
+	if rate <= 0 {
+		rate = samplerFor(bucket).rate()
+	}
+	if !sampled(rate) {
+		t.sampledOut = true
+	} else if rate < 1 {
+		t.rate = rate
+	}
+	rs.timers[bucket] = t
+}
+
+// FinishTimer implements Recorder. See the package-level FinishTimer for details.
+func (rs *requestStats) FinishTimer(bucket string) error {
+	t, ok := rs.timers[bucket]
+	if !ok {
+		return TimerNotStarted
+	}
+	err := t.finishAt(rs.now())
+	if err != nil {
+		return err
+	}
+	rs.finished[bucket] = time.Duration(t.Duration())
+	if t.sampledOut {
+		delete(rs.timers, bucket)
+		return nil
+	} else if rs.flushMode == FlushAtEnd {
+		return nil // sent with everything else
+	}
+	if err := rs.sendTimer(bucket); err != nil {
+		warnf(rs.ctx, "Error pushing finished timer %s into event stream: %s", bucket, err)
+	}
+	return nil
+}
+
+// SetGauge sets the gauge in the named bucket. See the package-level SetGauge.
+func (rs *requestStats) SetGauge(bucket string, value int) error {
+	g, ok := rs.gauges[bucket]
+	if !ok {
+		name, err := resolveMetricName(rs.namePolicy(), bucket, KindGauge)
+		if err != nil {
+			return err
+		}
+		g = makeGauge(rs.admit(name))
+		rs.gauges[bucket] = g
+	}
+	g.Set(value)
+	return nil
+}
+
+// Observe adds to the histogram in the named bucket. See the package-level Observe.
+func (rs *requestStats) Observe(bucket string, d time.Duration) error {
+	h, ok := rs.histograms[bucket]
+	if !ok {
+		name, err := resolveMetricName(rs.namePolicy(), bucket, KindHistogram)
+		if err != nil {
+			return err
+		}
+		h = makeHistogram(rs.admit(name))
+		rs.histograms[bucket] = h
+	}
+	h.Observe(d)
+	return nil
 }
 
 func newRequestStats() *requestStats {
 	rc := &requestStats{
-		counters: make(map[string]*Counter),
-		timers:   make(map[string]*Timer),
+		ctx:        context.Background(),
+		counters:   make(map[string]*Counter),
+		timers:     make(map[string]*Timer),
+		gauges:     make(map[string]*Gauge),
+		histograms: make(map[string]*Histogram),
+		finished:   make(map[string]time.Duration),
 	}
 	return rc
 }
 
+func (rs *requestStats) now() time.Time {
+	if rs.clock != nil {
+		return rs.clock()
+	}
+	return time.Now()
+}
+
+func (rs *requestStats) namePolicy() NamePolicy {
+	if rs.names != nil {
+		return rs.names
+	}
+	return CurrentNamePolicy()
+}
+
 // Send the counter in the requested bucket upstream, and delete it from
 // the map. If the counter's data == 0, don't bother sending it, since it's a noop,
 // data-wise.
@@ -218,32 +516,53 @@ func (rs *requestStats) _send(m Metric) error {
 	if rs.eventChannel == nil {
 		return NoSink
 	}
+	self.queued.Add(1)
 	rs.eventChannel <- m
 	return nil
 }
 
-// Send all metrics in the struct. Timers will not be sent if they aren't finished,
-// and counters won't be sent if they haven't counted anything. These behaviors mirror
-// the behaviors of the `sendTimer()` and `sendCounter()` one-offs.
+// Send all metrics in the struct, as one batch. Timers will not be sent if they aren't
+// finished, and counters won't be sent if they haven't counted anything. These behaviors
+// mirror the behaviors of the `sendTimer()` and `sendCounter()` one-offs.
+// The buckets are left in place; they're cleared when the struct goes back to the pool.
 func (rs *requestStats) sendAll() error {
 	if rs.eventChannel == nil {
 		return NoSink
 	}
 	me := make(multierror.MultiError, 0)
+	batch := make(Batch, 0, len(rs.timers)+len(rs.counters)+len(rs.gauges)+len(rs.histograms))
 	for _, timer := range rs.timers {
-		if !timer.Finished() {
+		if timer.sampledOut {
+			continue
+		} else if !timer.Finished() {
 			me = append(me, TimerNotFinished)
 			continue
 		}
-		rs.eventChannel <- timer
+		batch = append(batch, timer)
 	}
-	rs.timers = nil // this struct is now b0rked
 	for _, counter := range rs.counters {
 		if counter.Data() == 0 {
 			continue //not considering this an error. Zeroes are possible.
 		}
-		rs.eventChannel <- counter
+		batch = append(batch, counter)
+	}
+	for _, gauge := range rs.gauges {
+		batch = append(batch, gauge)
+	}
+	for _, histogram := range rs.histograms {
+		batch = append(batch, histogram)
+	}
+	if len(batch) > 0 {
+		self.queued.Add(int64(len(batch)))
+		rs.eventChannel <- &batchEvent{batch: batch}
 	}
-	rs.counters = nil
 	return me.NilWhenEmpty()
 }
+
+// batchEvent carries a Batch through the metrics channel
+type batchEvent struct {
+	batch Batch
+}
+
+func (b *batchEvent) Name() string { return "" }
+func (b *batchEvent) Data() int    { return len(b.batch) }
@@ -0,0 +1,257 @@
+package stats
+
+// MultiSink writes metrics to several Sinks at once, e.g. the old and new backends
+// during a migration:
+//
+//	multi := stats.NewMultiSink(0, stackdriver.Sink, promSink)
+//	defer multi.Close()
+//	router.Use(stats.Metrics(multi))
+//
+// Each destination has its own queue and its own goroutine, so a slow or failing
+// destination never holds up the others. Writes to a MultiSink only enqueue; when a
+// destination's queue is full, that destination (and only that one) drops the write,
+// and QueueFull is returned for it. Errors from the destinations themselves happen in
+// the background, so they're logged, and counted in Stats.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/efixler/multierror"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	QueueFull       = errors.New("Sink queue is full, metrics were dropped")
+	MultiSinkClosed = errors.New("MultiSink is closed")
+)
+
+// Writes that can be queued per destination, when no size is given to NewMultiSink
+const DefaultQueueSize = 1024
+
+// MultiSink fans metrics out to several Sinks. It implements all of the optional
+// capabilities in capabilities.go, passing them on to each destination.
+type MultiSink struct {
+	dests    []*destination
+	mu       sync.RWMutex // guards closed against writes racing with Close; never held while blocked
+	closed   bool
+	closing  chan struct{}  // closed by Close, to stop flushes waiting to queue their markers
+	flushers sync.WaitGroup // flushes that may still queue markers
+	wg       sync.WaitGroup
+}
+
+type destination struct {
+	sink    Sink // as given
+	out     Sink // with the sink's name translation
+	queue   chan multiJob
+	written atomic.Int64
+	dropped atomic.Int64
+	failed  atomic.Int64
+}
+
+// a multiJob is either a batch to write, or a marker (done != nil) that's closed once
+// everything queued before it has been written
+type multiJob struct {
+	ctx   context.Context
+	batch Batch
+	done  chan struct{}
+}
+
+// DestinationStats are the running totals for one of a MultiSink's destinations, in
+// terms of writes (batches) rather than metrics.
+type DestinationStats struct {
+	Sink    Sink
+	Queued  int   // Writes waiting in the queue
+	Written int64 // Writes that succeeded
+	Failed  int64 // Writes the sink returned an error for
+	Dropped int64 // Writes that were dropped because the queue was full
+}
+
+// NewMultiSink makes a MultiSink writing to sinks, each with a queue of queueSize writes
+// (or DefaultQueueSize, if queueSize isn't positive). A sink's own name translation is
+// applied to what's written to it, so each destination can use its own naming scheme.
+// The MultiSink runs a goroutine per destination until it's closed.
+func NewMultiSink(queueSize int, sinks ...Sink) *MultiSink {
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+	ms := &MultiSink{dests: make([]*destination, len(sinks)), closing: make(chan struct{})}
+	for i, sink := range sinks {
+		d := &destination{sink: sink, out: withNameTranslation(sink), queue: make(chan multiJob, queueSize)}
+		ms.dests[i] = d
+		ms.wg.Add(1)
+		go func() {
+			defer ms.wg.Done()
+			d.run()
+		}()
+	}
+	return ms
+}
+
+func (d *destination) run() {
+	for job := range d.queue {
+		if job.done != nil {
+			close(job.done)
+			continue
+		}
+		if err := WriteBatch(job.ctx, d.out, job.batch); err != nil {
+			d.failed.Add(1)
+			reportError(job.ctx, err, "Error writing metrics to %T", d.sink)
+			continue
+		}
+		d.written.Add(1)
+	}
+}
+
+func (ms *MultiSink) WriteCounters(ctx context.Context, counters ...*Counter) error {
+	batch := make(Batch, len(counters))
+	for i, c := range counters {
+		batch[i] = c
+	}
+	return ms.WriteBatch(ctx, batch)
+}
+
+func (ms *MultiSink) WriteTimers(ctx context.Context, timers ...*Timer) error {
+	batch := make(Batch, len(timers))
+	for i, t := range timers {
+		batch[i] = t
+	}
+	return ms.WriteBatch(ctx, batch)
+}
+
+func (ms *MultiSink) WriteGauges(ctx context.Context, gauges ...*Gauge) error {
+	batch := make(Batch, len(gauges))
+	for i, g := range gauges {
+		batch[i] = g
+	}
+	return ms.WriteBatch(ctx, batch)
+}
+
+func (ms *MultiSink) WriteHistograms(ctx context.Context, histograms ...*Histogram) error {
+	batch := make(Batch, len(histograms))
+	for i, h := range histograms {
+		batch[i] = h
+	}
+	return ms.WriteBatch(ctx, batch)
+}
+
+// WriteBatch queues the batch for each destination. The batch is shared, so it must
+// not be modified afterward. The writes happen with a copy of ctx that isn't canceled
+// along with it, since they may well outlast the request.
+func (ms *MultiSink) WriteBatch(ctx context.Context, batch Batch) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ms.closed {
+		return MultiSinkClosed
+	}
+	job := multiJob{ctx: context.WithoutCancel(ctx), batch: batch}
+	me := make(multierror.MultiError, 0)
+	for _, d := range ms.dests {
+		select {
+		case d.queue <- job:
+		default:
+			d.dropped.Add(1)
+			me = append(me, fmt.Errorf("%T: %w", d.sink, QueueFull))
+		}
+	}
+	return me.NilWhenEmpty()
+}
+
+// Flush waits for everything queued so far to be written, and then flushes each
+// destination that's a Flusher. If ctx is done first, ctx's error is returned for
+// the destinations that haven't caught up. A Flush waiting on a slow destination
+// doesn't hold up writes, or Close.
+func (ms *MultiSink) Flush(ctx context.Context) error {
+	ms.mu.RLock()
+	if ms.closed {
+		ms.mu.RUnlock()
+		return MultiSinkClosed
+	}
+	ms.flushers.Add(1) // Close waits for this before closing the queues
+	ms.mu.RUnlock()
+
+	markers := make([]chan struct{}, len(ms.dests))
+	me := make(multierror.MultiError, 0)
+	for i, d := range ms.dests {
+		markers[i] = make(chan struct{})
+		select {
+		case d.queue <- multiJob{done: markers[i]}:
+		case <-ctx.Done():
+			markers[i] = nil
+			me = append(me, fmt.Errorf("%T: %w", d.sink, ctx.Err()))
+		case <-ms.closing:
+			markers[i] = nil
+			me = append(me, fmt.Errorf("%T: %w", d.sink, MultiSinkClosed))
+		}
+	}
+	ms.flushers.Done()
+	for i, d := range ms.dests {
+		if markers[i] == nil {
+			continue
+		}
+		select {
+		case <-markers[i]:
+			if err := FlushSink(ctx, d.sink); err != nil {
+				me = append(me, err)
+			}
+		case <-ctx.Done():
+			me = append(me, fmt.Errorf("%T: %w", d.sink, ctx.Err()))
+		}
+	}
+	return me.NilWhenEmpty()
+}
+
+// Close stops accepting writes, waits for the queues to empty, and then closes each
+// destination that's a Closer.
+func (ms *MultiSink) Close() error {
+	ms.mu.Lock()
+	if ms.closed {
+		ms.mu.Unlock()
+		return MultiSinkClosed
+	}
+	ms.closed = true
+	ms.mu.Unlock()
+	close(ms.closing)
+	ms.flushers.Wait()
+	for _, d := range ms.dests {
+		close(d.queue)
+	}
+	ms.wg.Wait()
+	me := make(multierror.MultiError, 0)
+	for _, d := range ms.dests {
+		if err := CloseSink(d.sink); err != nil {
+			me = append(me, err)
+		}
+	}
+	return me.NilWhenEmpty()
+}
+
+// Healthy checks each destination that's a HealthChecker, returning all of the failures.
+func (ms *MultiSink) Healthy(ctx context.Context) error {
+	me := make(multierror.MultiError, 0)
+	for _, d := range ms.dests {
+		if err := CheckHealth(ctx, d.sink); err != nil {
+			me = append(me, err)
+		}
+	}
+	return me.NilWhenEmpty()
+}
+
+// Stats returns the totals for each destination, in the order they were passed to NewMultiSink.
+func (ms *MultiSink) Stats() []DestinationStats {
+	stats := make([]DestinationStats, len(ms.dests))
+	for i, d := range ms.dests {
+		stats[i] = DestinationStats{
+			Sink:    d.sink,
+			Queued:  len(d.queue),
+			Written: d.written.Load(),
+			Failed:  d.failed.Load(),
+			Dropped: d.dropped.Load(),
+		}
+	}
+	return stats
+}
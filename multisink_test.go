@@ -0,0 +1,139 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"github.com/efixler/multierror"
+	"testing"
+	"time"
+)
+
+// blockingSink holds every write until it's released
+type blockingSink struct {
+	recordingSink
+	release chan struct{}
+}
+
+func (bs *blockingSink) WriteCounters(ctx context.Context, counters ...*Counter) error {
+	<-bs.release
+	return bs.recordingSink.WriteCounters(ctx, counters...)
+}
+
+func (bs *blockingSink) WriteTimers(ctx context.Context, timers ...*Timer) error {
+	<-bs.release
+	return bs.recordingSink.WriteTimers(ctx, timers...)
+}
+
+type failingSink struct{ nopSink }
+
+func (failingSink) WriteCounters(ctx context.Context, counters ...*Counter) error {
+	return errors.New("failed")
+}
+
+func testCounter(name string, n int) *Counter {
+	c := makeCounter(name)
+	c.data = n
+	return c
+}
+
+func TestMultiSinkIsolatesDestinations(t *testing.T) {
+	ctx := context.Background()
+	slow := &blockingSink{release: make(chan struct{})}
+	fast := &recordingSink{}
+	ms := NewMultiSink(2, slow, fast, failingSink{})
+
+	for i := 0; i < 2; i++ {
+		if err := ms.WriteCounters(ctx, testCounter("test/counter", 1)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	// the fast sink gets everything while the slow one is still stuck
+	waitFor(t, func() bool {
+		fast.mu.Lock()
+		defer fast.mu.Unlock()
+		return len(fast.counters) == 2
+	})
+	var err error
+	for i := 0; i < 2; i++ {
+		err = ms.WriteCounters(ctx, testCounter("test/counter", 1))
+	}
+	if !hasError(err, QueueFull) {
+		t.Errorf("Expected QueueFull for the slow sink, got %v", err)
+	}
+	close(slow.release)
+	if err := ms.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	stats := ms.Stats()
+	if stats[0].Written+stats[0].Dropped != 4 || stats[0].Dropped == 0 {
+		t.Errorf("Expected the slow sink to drop some of 4 writes, got %+v", stats[0])
+	}
+	if stats[1].Written != 4 || stats[1].Dropped != 0 {
+		t.Errorf("Expected the fast sink to write everything, got %+v", stats[1])
+	}
+	if stats[2].Failed != 4 {
+		t.Errorf("Expected 4 failures, got %+v", stats[2])
+	}
+	if err := ms.WriteCounters(ctx, testCounter("test/counter", 1)); err != MultiSinkClosed {
+		t.Errorf("Expected %s after close, got %v", MultiSinkClosed, err)
+	}
+}
+
+func TestMultiSinkFlushTimeout(t *testing.T) {
+	slow := &blockingSink{release: make(chan struct{})}
+	defer close(slow.release)
+	ms := NewMultiSink(0, slow)
+	ms.WriteCounters(context.Background(), testCounter("test/counter", 1))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := ms.Flush(ctx); !hasError(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the flush to time out, got %v", err)
+	}
+}
+
+func TestMultiSinkFlushAndCloseDontBlockWrites(t *testing.T) {
+	ctx := context.Background()
+	hung := &blockingSink{release: make(chan struct{})}
+	ms := NewMultiSink(1, hung)
+	ms.WriteCounters(ctx, testCounter("test/counter", 1))
+	waitFor(t, func() bool { return ms.Stats()[0].Queued == 0 }) // the destination is stuck on it
+	ms.WriteCounters(ctx, testCounter("test/counter", 2))        // and the queue is full
+
+	flushed, closed := make(chan error, 1), make(chan error, 1)
+	go func() { flushed <- ms.Flush(ctx) }()
+	time.Sleep(10 * time.Millisecond) // the flush is waiting to queue its marker
+	go func() { closed <- ms.Close() }()
+	time.Sleep(10 * time.Millisecond) // and Close is under way
+
+	written := make(chan error, 1)
+	go func() { written <- ms.WriteCounters(ctx, testCounter("test/counter", 3)) }()
+	select {
+	case err := <-written:
+		if err != MultiSinkClosed && !hasError(err, QueueFull) {
+			t.Errorf("Expected the write to be turned away, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Write blocked behind Flush and Close")
+	}
+	close(hung.release)
+	if err := <-flushed; !hasError(err, MultiSinkClosed) {
+		t.Errorf("Expected the flush to be cut short by Close, got %v", err)
+	}
+	if err := <-closed; err != nil {
+		t.Errorf("Unexpected error closing: %s", err)
+	}
+}
+
+// hasError reports whether target is in (or wrapped by an error in) a MultiError
+func hasError(err error, target error) bool {
+	me, ok := err.(multierror.MultiError)
+	if !ok {
+		return errors.Is(err, target)
+	}
+	for _, e := range me {
+		if errors.Is(e, target) {
+			return true
+		}
+	}
+	return false
+}
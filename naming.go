@@ -0,0 +1,214 @@
+package stats
+
+// Naming is handled in two places. A NamePolicy decides, at recording time, which
+// bucket names are acceptable and what they're recorded as. A NameTranslator then
+// rewrites the recorded names into whatever form a particular backend wants, on the
+// way to the Sink. This way one call site can feed several different backends.
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// NamePolicy validates (and optionally rewrites) bucket names at recording time.
+// CheckName returns the name the metric should be recorded under, or an error
+// (generally IllegalMetricName) if the name can't be used.
+type NamePolicy interface {
+	CheckName(name string) (string, error)
+}
+
+// NamePolicyFunc adapts a function to the NamePolicy interface.
+type NamePolicyFunc func(name string) (string, error)
+
+func (f NamePolicyFunc) CheckName(name string) (string, error) {
+	return f(name)
+}
+
+var (
+	// StrictNames is the default policy. Names must start with a lowercase letter,
+	// end with a letter or digit, contain only alphanumerics, underscores, dots and
+	// slashes, be at least 3 characters long and not have consecutive dots or slashes.
+	StrictNames NamePolicy = NamePolicyFunc(strictName)
+
+	// PermissiveNames also allows dashes, uppercase first letters, and names of
+	// any length. Names must still start with a letter, must not end with a separator,
+	// and must not have consecutive separators (dots, slashes or dashes).
+	PermissiveNames NamePolicy = NamePolicyFunc(permissiveName)
+
+	// SanitizeNames rewrites names rather than rejecting them. The results satisfy
+	// PermissiveNames: illegal characters become underscores, runs of separators are
+	// collapsed, and leading non-letters and trailing separators are removed. Only
+	// names that sanitize down to nothing are rejected.
+	SanitizeNames NamePolicy = NamePolicyFunc(sanitizeName)
+)
+
+var namePolicy atomic.Value
+
+func init() {
+	namePolicy.Store(&StrictNames)
+}
+
+// SetNamePolicy changes the policy used to check bucket names. Set the policy before
+// recording any metrics; buckets aren't rechecked when the policy changes.
+func SetNamePolicy(p NamePolicy) {
+	namePolicy.Store(&p)
+}
+
+// CurrentNamePolicy returns the policy set with SetNamePolicy (StrictNames by default).
+func CurrentNamePolicy() NamePolicy {
+	return *namePolicy.Load().(*NamePolicy)
+}
+
+// metricName runs name through the current policy
+func metricName(name string) (string, error) {
+	return checkName(CurrentNamePolicy(), name)
+}
+
+// checkName runs name through policy, and keeps the reserved names for the stats
+// package's own use
+func checkName(policy NamePolicy, name string) (string, error) {
+	checked, err := policy.CheckName(name)
+	if err == nil && isReservedName(checked) {
+		err = ReservedMetricName
+	}
+	if err != nil {
+		self.rejectedNames.Add(1)
+		return "", err
+	}
+	return checked, nil
+}
+
+func strictName(name string) (string, error) {
+	if err := checkMetricName(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+var permissiveMetricName = regexp.MustCompile(`^[a-zA-Z](?:[\w]|[./-][\w])*$`)
+
+func permissiveName(name string) (string, error) {
+	if !permissiveMetricName.MatchString(name) {
+		return "", IllegalMetricName
+	}
+	return name, nil
+}
+
+func isSeparator(r rune) bool {
+	return r == '.' || r == '/' || r == '-'
+}
+
+func isLetter(r rune) bool {
+	return ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z')
+}
+
+// isWordChar matches \w
+func isWordChar(r rune) bool {
+	return isLetter(r) || ('0' <= r && r <= '9') || r == '_'
+}
+
+func sanitizeName(name string) (string, error) {
+	if permissiveMetricName.MatchString(name) {
+		return name, nil
+	}
+	var b strings.Builder
+	b.Grow(len(name))
+	var last rune
+	for _, r := range name {
+		switch {
+		case b.Len() == 0 && !isLetter(r):
+			continue // names have to start with a letter
+		case isWordChar(r):
+		case isSeparator(r):
+			if isSeparator(last) {
+				continue
+			}
+		default:
+			r = '_'
+		}
+		b.WriteRune(r)
+		last = r
+	}
+	s := strings.TrimRightFunc(b.String(), isSeparator)
+	if s == "" {
+		return "", IllegalMetricName
+	}
+	return s, nil
+}
+
+// NameTranslator can be implemented by a Sink whose backend has its own naming rules.
+// The stats package will pass each metric name through TranslateName before it's
+// written to the sink.
+type NameTranslator interface {
+	TranslateName(name string) string
+}
+
+// NameTranslatorFunc adapts a function to the NameTranslator interface.
+type NameTranslatorFunc func(name string) string
+
+func (f NameTranslatorFunc) TranslateName(name string) string {
+	return f(name)
+}
+
+var (
+	// PrometheusNames converts all separators to underscores, and anything else that
+	// Prometheus doesn't allow to an underscore as well.
+	PrometheusNames NameTranslator = NameTranslatorFunc(func(name string) string {
+		return strings.Map(func(r rune) rune {
+			if isWordChar(r) || r == ':' {
+				return r
+			}
+			return '_'
+		}, name)
+	})
+
+	// GraphiteNames converts slashes to dots, which are Graphite's path separator.
+	GraphiteNames NameTranslator = NameTranslatorFunc(func(name string) string {
+		return strings.Map(func(r rune) rune {
+			if r == '/' {
+				return '.'
+			} else if isWordChar(r) || r == '-' || r == '.' {
+				return r
+			}
+			return '_'
+		}, name)
+	})
+
+	// StackdriverNames keeps slashes (Stackdriver's path separator) and dots, and
+	// converts anything else that can't appear in a custom metric type to an underscore.
+	StackdriverNames NameTranslator = NameTranslatorFunc(func(name string) string {
+		return strings.Map(func(r rune) rune {
+			if isWordChar(r) || r == '/' || r == '.' {
+				return r
+			}
+			return '_'
+		}, name)
+	})
+)
+
+// TranslateNames wraps sink so that all of the metrics written to it are renamed by t.
+// This is done automatically for Sinks that implement NameTranslator; use TranslateNames
+// to apply a translation to a sink that doesn't. (If it does, its own translation is
+// applied after t.)
+func TranslateNames(sink Sink, t NameTranslator) Sink {
+	return translateNames(withNameTranslation(sink), t)
+}
+
+func translateNames(sink Sink, t NameTranslator) Sink {
+	return &transformSink{
+		Sink: sink,
+		transform: func(ctx context.Context, m Metric) []Metric {
+			return []Metric{withIdentity(m, t.TranslateName(m.Name()), tagsOf(m))}
+		},
+	}
+}
+
+// withNameTranslation applies a sink's own name translation, if it has one
+func withNameTranslation(sink Sink) Sink {
+	if t, ok := sink.(NameTranslator); ok {
+		return translateNames(sink, t)
+	}
+	return sink
+}
@@ -0,0 +1,115 @@
+package stats
+
+import (
+	"context"
+	"testing"
+)
+
+var policyChecks = []struct {
+	policy   NamePolicy
+	name     string
+	expected string
+	err      error
+}{
+	{StrictNames, "my/test/metric", "my/test/metric", nil},
+	{StrictNames, "my-test-metric", "", IllegalMetricName},
+	{StrictNames, "Metric", "", IllegalMetricName},
+	{PermissiveNames, "my-test-metric", "my-test-metric", nil},
+	{PermissiveNames, "Metric", "Metric", nil},
+	{PermissiveNames, "m", "m", nil},
+	{PermissiveNames, "double--dash", "", IllegalMetricName},
+	{PermissiveNames, "ends/with/", "", IllegalMetricName},
+	{SanitizeNames, "my/test/metric", "my/test/metric", nil},
+	{SanitizeNames, "with/double//slashes.name", "with/double/slashes.name", nil},
+	{SanitizeNames, "ends/with/.", "ends/with", nil},
+	{SanitizeNames, "illegal/char&", "illegal/char_", nil},
+	{SanitizeNames, "9lives", "lives", nil},
+	{SanitizeNames, "user id:42", "user_id_42", nil},
+	{SanitizeNames, "../", "", IllegalMetricName},
+}
+
+func TestNamePolicies(t *testing.T) {
+	for _, test := range policyChecks {
+		name, err := test.policy.CheckName(test.name)
+		if err != test.err || name != test.expected {
+			t.Errorf("Checking %q: expected (%q, %v), got (%q, %v)", test.name, test.expected, test.err, name, err)
+		}
+	}
+}
+
+func TestSetNamePolicy(t *testing.T) {
+	defer SetNamePolicy(StrictNames)
+	SetNamePolicy(SanitizeNames)
+	ctx := requestContextUsingMetrics()
+	if err := Increment(ctx, "cache-hit"); err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	rs, _ := statsFromContext(ctx)
+	if c := rs.counters["cache-hit"]; c == nil || c.Name() != "cache-hit" {
+		t.Errorf("Expected counter named cache-hit, got %v", c)
+	}
+	if err := Increment(ctx, "cache hit"); err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if c := rs.counters["cache hit"]; c == nil || c.Name() != "cache_hit" {
+		t.Errorf("Expected counter named cache_hit, got %v", c)
+	}
+}
+
+var translations = []struct {
+	translator NameTranslator
+	name       string
+	expected   string
+}{
+	{PrometheusNames, "api.users/get-latency", "api_users_get_latency"},
+	{GraphiteNames, "api/users/get", "api.users.get"},
+	{StackdriverNames, "api.users/get-latency", "api.users/get_latency"},
+}
+
+func TestNameTranslators(t *testing.T) {
+	for _, test := range translations {
+		if name := test.translator.TranslateName(test.name); name != test.expected {
+			t.Errorf("Translating %q: expected %q, got %q", test.name, test.expected, name)
+		}
+	}
+}
+
+func TestTranslateNames(t *testing.T) {
+	sink := &recordingSink{}
+	c := makeCounter("api/users/get")
+	TranslateNames(sink, GraphiteNames).WriteCounters(context.Background(), c)
+	if len(sink.counters) != 1 || sink.counters[0].Name() != "api.users.get" {
+		t.Errorf("Expected translated counter, got %v", sink.counters)
+	}
+	if c.Name() != "api/users/get" {
+		t.Errorf("Original counter should not be renamed, got %s", c.Name())
+	}
+}
+
+// translatingSink is a backend with its own naming rules
+type translatingSink struct {
+	recordingSink
+}
+
+func (ts *translatingSink) TranslateName(name string) string {
+	return GraphiteNames.TranslateName(name)
+}
+
+func TestDecoratorsKeepNameTranslation(t *testing.T) {
+	rules, _ := ParseRules([]byte(`rules: [{match: '^api/', action: tag, tags: {tier: web}}]`))
+	mapper, _ := ParseMappings([]byte(testMappings))
+	aliases, _ := NewAliases()
+	decorators := map[string]func(Sink) Sink{
+		"rules":   func(s Sink) Sink { return ApplyRules(s, rules) },
+		"mapping": func(s Sink) Sink { return MapNames(s, mapper) },
+		"aliases": func(s Sink) Sink { return WithAliases(s, aliases) },
+		"limit":   func(s Sink) Sink { return LimitSeries(s, 10) },
+	}
+	for name, decorate := range decorators {
+		sink := &translatingSink{}
+		decorate(sink).WriteCounters(context.Background(), makeCounter("api/users/get"))
+		if len(sink.counters) != 1 || sink.counters[0].Name() != "api.users.get" {
+			t.Errorf("%s: expected the sink's translation to be applied, got %v", name, sink.counters)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package stats
+
+// Options configure the pipeline made by Metrics, i.e. the metrics of the requests
+// that pass through one Metrics middleware:
+//
+//	router.Use(stats.Metrics(sink,
+//	    stats.WithPrefix("checkout/"),
+//	    stats.WithTags(stats.Tags{"region": region}),
+//	    stats.WithFlushMode(stats.FlushAtEnd),
+//	))
+//
+// Anything that isn't set by an option falls back to the process-wide setting, if
+// there is one (SetNamePolicy, SetLogger, SetErrorHandler), and otherwise to the
+// behavior of a plain Metrics(sink).
+
+import (
+	"context"
+	"time"
+)
+
+// An Option configures the pipeline made by Metrics.
+type Option func(*pipeline)
+
+// FlushMode decides when a request's metrics are sent to the sink.
+type FlushMode int
+
+const (
+	// FlushEager sends each timer as soon as it's finished, and the rest of the
+	// request's metrics when the request is done. This is the default.
+	FlushEager FlushMode = iota
+
+	// FlushAtEnd sends all of the request's metrics together, in one batch, when the
+	// request is done.
+	FlushAtEnd
+)
+
+// pipeline holds the configuration of one Metrics middleware. Unset fields fall back
+// to the process's defaults, as they are when they're used.
+type pipeline struct {
+	logger     Logger
+	onError    ErrorHandler
+	hooks      []FlushHook
+	prefix     string
+	tags       Tags
+	flushMode  FlushMode
+	bufferSize int
+	clock      func() time.Time
+	names      NamePolicy
+}
+
+// WithLogger sets the pipeline's Logger.
+func WithLogger(l Logger) Option {
+	return func(p *pipeline) {
+		p.logger = l
+	}
+}
+
+// WithErrorHandler sets the pipeline's ErrorHandler.
+func WithErrorHandler(h ErrorHandler) Option {
+	return func(p *pipeline) {
+		p.onError = h
+	}
+}
+
+// OnFlush adds a hook to be called with each request's metrics once they've been
+// flushed. Hooks are called even if the pipeline has no sink. See snapshot.go.
+func OnFlush(hook FlushHook) Option {
+	return func(p *pipeline) {
+		p.hooks = append(p.hooks, hook)
+	}
+}
+
+// WithPrefix prepends prefix to the names of the metrics written to the sink. The
+// prefix isn't checked by the NamePolicy, and comes before the sink's own name
+// translation, if it has one.
+func WithPrefix(prefix string) Option {
+	return func(p *pipeline) {
+		p.prefix = prefix
+	}
+}
+
+// WithTags adds tags to all of the metrics written to the sink. Tags that a metric
+// already has take precedence.
+func WithTags(tags Tags) Option {
+	return func(p *pipeline) {
+		p.tags = Tags(nil).With(tags)
+	}
+}
+
+// WithFlushMode sets when the pipeline's metrics are sent to the sink. The default is
+// FlushEager.
+func WithFlushMode(mode FlushMode) Option {
+	return func(p *pipeline) {
+		p.flushMode = mode
+	}
+}
+
+// WithBufferSize buffers up to n metrics on their way to the sink. By default there's
+// no buffer, so finishing a timer waits for the sink to finish writing the last one.
+func WithBufferSize(n int) Option {
+	return func(p *pipeline) {
+		p.bufferSize = n
+	}
+}
+
+// WithClock sets the clock that the pipeline's timers use, e.g. for tests.
+func WithClock(now func() time.Time) Option {
+	return func(p *pipeline) {
+		p.clock = now
+	}
+}
+
+// WithNamePolicy sets the NamePolicy for the pipeline's buckets, in place of the one
+// set with SetNamePolicy. Handles (see NewCounter) are checked against it too, when
+// they're used in the pipeline's requests.
+func WithNamePolicy(policy NamePolicy) Option {
+	return func(p *pipeline) {
+		p.names = policy
+	}
+}
+
+func newPipeline(opts []Option) *pipeline {
+	if len(opts) == 0 {
+		return nil
+	}
+	p := &pipeline{}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// decorate wraps the pipeline's sink to apply its prefix and tags, and the sink's own
+// name translation
+func (p *pipeline) decorate(sink Sink) Sink {
+	if p == nil || (p.prefix == "" && len(p.tags) == 0) {
+		return withNameTranslation(sink)
+	}
+	return newTransformSink(sink, func(ctx context.Context, m Metric) []Metric {
+		tags := tagsOf(m)
+		if len(p.tags) > 0 {
+			tags = p.tags.With(tags)
+		}
+		return []Metric{withIdentity(m, p.prefix+m.Name(), tags)}
+	})
+}
+
+// configure applies the pipeline's settings to a request's metrics
+func (p *pipeline) configure(rs *requestStats) {
+	if p == nil {
+		return
+	}
+	rs.flushMode = p.flushMode
+	rs.clock = p.clock
+	rs.names = p.names
+}
+
+type pipelineContextKey string
+
+const pipelineKey = pipelineContextKey("pipeline")
+
+func pipelineToContext(ctx context.Context, p *pipeline) context.Context {
+	if p == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, pipelineKey, p)
+}
+
+func pipelineFromContext(ctx context.Context) (*pipeline, bool) {
+	p, ok := ctx.Value(pipelineKey).(*pipeline)
+	return p, ok
+}
+
+// namePolicyFor is the NamePolicy of the ctx's pipeline, or the current one
+func namePolicyFor(ctx context.Context) NamePolicy {
+	if p, ok := pipelineFromContext(ctx); ok && p.names != nil {
+		return p.names
+	}
+	return CurrentNamePolicy()
+}
+
+// withPipelineOf carries the pipeline of from over to ctx, for work that's done in
+// the background on a fresh context
+func withPipelineOf(ctx, from context.Context) context.Context {
+	p, _ := pipelineFromContext(from)
+	return pipelineToContext(ctx, p)
+}
@@ -0,0 +1,132 @@
+package stats
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serve runs f as the handler of one request through the middleware, and finishes
+// the request
+func serve(mw func(http.Handler) http.Handler, f func(w http.ResponseWriter, r *http.Request)) *httptest.ResponseRecorder {
+	return serveRequest(mw, httptest.NewRequest("GET", "/", nil), f)
+}
+
+func serveRequest(mw func(http.Handler) http.Handler, r *http.Request, f func(w http.ResponseWriter, r *http.Request)) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	mw(http.HandlerFunc(f)).ServeHTTP(w, r.WithContext(ctx))
+	return w
+}
+
+// batchSink records the size of each batch written to it
+type batchSink struct {
+	recordingSink
+	sizes []int
+}
+
+func (bs *batchSink) WriteBatch(ctx context.Context, batch Batch) error {
+	bs.mu.Lock()
+	bs.sizes = append(bs.sizes, len(batch))
+	bs.mu.Unlock()
+	return WriteBatch(ctx, &bs.recordingSink, batch)
+}
+
+func TestPrefixAndTags(t *testing.T) {
+	sink := &recordingSink{}
+	serve(Metrics(sink, WithPrefix("app/"), WithTags(Tags{"region": "us"})), func(w http.ResponseWriter, r *http.Request) {
+		Increment(r.Context(), "test/counter")
+	})
+	waitFor(t, func() bool {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		return len(sink.counters) == 1
+	})
+	c := sink.counters[0]
+	if c.Name() != "app/test/counter" || c.Tags()["region"] != "us" {
+		t.Errorf("Expected a prefixed and tagged counter, got %s{%s}", c.Name(), c.Tags())
+	}
+}
+
+func TestFlushMode(t *testing.T) {
+	for _, mode := range []FlushMode{FlushEager, FlushAtEnd} {
+		sink := &batchSink{}
+		serve(Metrics(sink, WithFlushMode(mode)), func(w http.ResponseWriter, r *http.Request) {
+			StartTimer(r.Context(), "test/timer")
+			FinishTimer(r.Context(), "test/timer")
+			Increment(r.Context(), "test/counter")
+		})
+		waitFor(t, func() bool {
+			sink.mu.Lock()
+			defer sink.mu.Unlock()
+			return len(sink.sizes) == 1 && len(sink.timers) == 1
+		})
+		want := 1
+		if mode == FlushAtEnd {
+			want = 2 // the timer comes along with the counter
+		}
+		if sink.sizes[0] != want {
+			t.Errorf("Expected a batch of %d in mode %d, got %d", want, mode, sink.sizes[0])
+		}
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{})}
+	defer close(sink.release)
+	done := make(chan struct{})
+	go serve(Metrics(sink, WithBufferSize(4)), func(w http.ResponseWriter, r *http.Request) {
+		for _, bucket := range []string{"test/one", "test/two", "test/three"} {
+			StartTimer(r.Context(), bucket)
+			FinishTimer(r.Context(), bucket)
+		}
+		close(done)
+	})
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Finishing timers blocked on the sink")
+	}
+}
+
+func TestClockAndNamePolicy(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Unix(1000, 0)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	snapshots := make(chan RequestSnapshot, 1)
+	mw := Metrics(nil,
+		WithClock(clock),
+		WithNamePolicy(PermissiveNames),
+		OnFlush(func(ctx context.Context, s RequestSnapshot) { snapshots <- s }),
+	)
+	serve(mw, func(w http.ResponseWriter, r *http.Request) {
+		if err := StartTimer(r.Context(), "Test-Timer"); err != nil {
+			t.Errorf("Expected the pipeline's name policy to allow the name, got %s", err)
+		}
+		mu.Lock()
+		now = now.Add(5 * time.Second)
+		mu.Unlock()
+		FinishTimer(r.Context(), "Test-Timer")
+	})
+	select {
+	case s := <-snapshots:
+		if d, _ := s.Timer("Test-Timer"); d != 5*time.Second {
+			t.Errorf("Expected the pipeline's clock to time 5s, got %s", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Request wasn't flushed")
+	}
+
+	ctx := requestContextUsingMetrics()
+	if err := StartTimer(ctx, "Test-Timer"); err != IllegalMetricName {
+		t.Errorf("Other pipelines should use the process's name policy, got %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package stats
+
+// Per-request state is pooled, so that a busy server isn't allocating a fresh
+// set of bucket maps for every request.
+//
+// The allocation target for the recording APIs is zero in the steady state: once a
+// bucket exists in a request, Increment, StartTimer, FinishTimer and the handle
+// equivalents don't allocate. Creating a bucket allocates its metric (once per bucket
+// per request), because metrics are handed off to the Sink and may outlive the
+// request. For the same reason, a timer that's finished and sent right away (the
+// default FlushEager mode) has to be replaced when it's started again: that's one
+// allocation for the Timer, plus the slice the Sink is called with. Timers that
+// haven't been sent yet, as with FlushAtEnd, are restarted in place. TestAllocations
+// in pool_test.go holds these numbers, and the benchmarks there track them.
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Maps that grew beyond this many buckets aren't worth keeping around
+const maxPooledBuckets = 256
+
+var requestStatsPool = sync.Pool{
+	New: func() interface{} {
+		return newRequestStats()
+	},
+}
+
+func acquireRequestStats() *requestStats {
+	return requestStatsPool.Get().(*requestStats)
+}
+
+// releaseRequestStats invalidates any contexts still pointing at rs and returns
+// it to the pool. It must only be called once the request's metrics have been flushed.
+func releaseRequestStats(rs *requestStats) {
+	rs.mu.Lock()
+	rs.gen.Add(1)
+	rs.ctx = context.Background()
+	rs.eventChannel = nil
+	rs.flushMode, rs.clock, rs.names = FlushEager, nil, nil
+	clear(rs.hooks)
+	rs.hooks, rs.flushing, rs.hooksRun = rs.hooks[:0], false, false
+	if len(rs.counters) > maxPooledBuckets || len(rs.timers) > maxPooledBuckets {
+		rs.counters = make(map[string]*Counter)
+		rs.timers = make(map[string]*Timer)
+	} else {
+		clear(rs.counters)
+		clear(rs.timers)
+	}
+	if len(rs.gauges) > maxPooledBuckets || len(rs.histograms) > maxPooledBuckets {
+		rs.gauges = make(map[string]*Gauge)
+		rs.histograms = make(map[string]*Histogram)
+	} else {
+		clear(rs.gauges)
+		clear(rs.histograms)
+	}
+	if len(rs.finished) > maxPooledBuckets {
+		rs.finished = make(map[string]time.Duration)
+	} else {
+		clear(rs.finished)
+	}
+	rs.mu.Unlock()
+	requestStatsPool.Put(rs)
+}
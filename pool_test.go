@@ -0,0 +1,190 @@
+package stats
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type nopSink struct{}
+
+func (nopSink) WriteCounters(ctx context.Context, counters ...*Counter) error { return nil }
+func (nopSink) WriteTimers(ctx context.Context, timers ...*Timer) error       { return nil }
+
+func TestReleasedStatsAreDetached(t *testing.T) {
+	rs := acquireRequestStats()
+	ctx := statsToContext(context.Background(), rs)
+	Increment(ctx, "my/test/metric")
+	releaseRequestStats(rs)
+	if err := Increment(ctx, "my/test/metric"); err != RequestMetricsNotInitted {
+		t.Errorf("Expected %s after release, got %v", RequestMetricsNotInitted, err)
+	}
+	if len(rs.counters) != 0 {
+		t.Errorf("Released stats should be empty, got %d counters", len(rs.counters))
+	}
+	if r := FromContext(ctx); r != NopRecorder {
+		t.Errorf("Expected NopRecorder after release, got %T", r)
+	}
+}
+
+func TestRetainedRecorderIsDetached(t *testing.T) {
+	rs := acquireRequestStats()
+	r := FromContext(statsToContext(context.Background(), rs))
+	releaseRequestStats(rs)
+
+	next := acquireRequestStats()
+	defer releaseRequestStats(next)
+	statsToContext(context.Background(), next)
+	if err := r.Increment("leaked/counter"); err != RequestMetricsNotInitted {
+		t.Errorf("Expected %s from a released Recorder, got %v", RequestMetricsNotInitted, err)
+	}
+	if err := r.StartTimer("leaked/timer"); err != RequestMetricsNotInitted {
+		t.Errorf("Expected %s from a released Recorder, got %v", RequestMetricsNotInitted, err)
+	}
+	if len(next.counters) != 0 || len(next.timers) != 0 {
+		t.Errorf("Released Recorder wrote into the next request: %v %v", next.counters, next.timers)
+	}
+}
+
+// A goroutine that outlives its request keeps recording while later requests reuse
+// the pooled state. Run with -race.
+func TestLeakedGoroutineDoesNotTouchOtherRequests(t *testing.T) {
+	leaked := make(chan struct{})
+	snapshots := make(chan RequestSnapshot, 1)
+	mw := Metrics(nil, OnFlush(func(ctx context.Context, s RequestSnapshot) { snapshots <- s }))
+	stop := make(chan struct{})
+	defer close(stop)
+	for i := 0; i < 200; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+		serveRequest(mw, r, func(w http.ResponseWriter, r *http.Request) {
+			Increment(r.Context(), "mine")
+			if i == 0 {
+				rec := FromContext(r.Context())
+				go func() {
+					close(leaked)
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+							Increment(r.Context(), "leaked/counter")
+							rec.StartTimer("leaked/timer")
+						}
+					}
+				}()
+				<-leaked
+			}
+		})
+		cancel()
+		s := <-snapshots
+		if n, _ := s.Counter("mine"); n != 1 || (len(s.Counters()) != 1 && i > 0) {
+			t.Fatalf("Request %d saw another request's metrics: %v %v", i, s.Counters(), s.Timers())
+		} else if _, ok := s.Timer("leaked/timer"); ok && i > 0 {
+			t.Fatalf("Request %d saw a leaked timer", i)
+		}
+	}
+}
+
+// sinkContext is a request context with a sink that discards everything, so that
+// allocation counts aren't thrown off by the warnings about there being no sink
+func sinkContext(tb testing.TB, mode FlushMode) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	tb.Cleanup(cancel)
+	rs := newRequestStats()
+	rs.flushMode = mode
+	return initRequestContext(ctx, rs, nopSink{})
+}
+
+func TestAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("Allocations aren't meaningful with the race detector")
+	}
+	ctx := sinkContext(t, FlushEager)
+	h := NewCounter("alloc/handle")
+	Increment(ctx, "alloc/counter")
+	h.Increment(ctx)
+	if n := testing.AllocsPerRun(100, func() {
+		Increment(ctx, "alloc/counter")
+		h.Increment(ctx)
+	}); n != 0 {
+		t.Errorf("Expected incrementing existing counters not to allocate, got %v allocations", n)
+	}
+
+	// the Timer and the slice it's written to the sink in
+	if n := testing.AllocsPerRun(100, func() {
+		StartTimer(ctx, "alloc/timer")
+		FinishTimer(ctx, "alloc/timer")
+	}); n > 2 {
+		t.Errorf("Expected at most 2 allocations for a timer that's sent, got %v", n)
+	}
+
+	ctx = sinkContext(t, FlushAtEnd)
+	th := NewTimer("alloc/handle")
+	StartTimer(ctx, "alloc/timer")
+	th.Start(ctx)
+	if n := testing.AllocsPerRun(100, func() {
+		StartTimer(ctx, "alloc/timer")
+		FinishTimer(ctx, "alloc/timer")
+		th.Start(ctx)
+		th.Finish(ctx)
+	}); n != 0 {
+		t.Errorf("Expected restarting unsent timers not to allocate, got %v allocations", n)
+	}
+}
+
+var flushModes = []struct {
+	name string
+	mode FlushMode
+}{
+	{"Eager", FlushEager},
+	{"AtEnd", FlushAtEnd},
+}
+
+func BenchmarkTimer(b *testing.B) {
+	for _, m := range flushModes {
+		b.Run(m.name, func(b *testing.B) {
+			ctx := sinkContext(b, m.mode)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				StartTimer(ctx, "bench/timer")
+				FinishTimer(ctx, "bench/timer")
+			}
+		})
+	}
+}
+
+func BenchmarkTimerHandle(b *testing.B) {
+	for _, m := range flushModes {
+		b.Run(m.name, func(b *testing.B) {
+			ctx := sinkContext(b, m.mode)
+			h := NewTimer("bench/timer")
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h.Start(ctx)
+				h.Finish(ctx)
+			}
+		})
+	}
+}
+
+func BenchmarkMiddleware(b *testing.B) {
+	handler := Metrics(nopSink{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		StartTimer(r.Context(), "bench/timer")
+		Increment(r.Context(), "bench/counter")
+		Increment(r.Context(), "bench/counter")
+		FinishTimer(r.Context(), "bench/timer")
+	}))
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/bench", nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx, cancel := context.WithCancel(req.Context())
+		handler.ServeHTTP(w, req.WithContext(ctx))
+		cancel()
+	}
+}
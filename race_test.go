@@ -0,0 +1,6 @@
+//go:build race
+
+package stats
+
+// the race detector adds allocations of its own, so allocation counts aren't checked
+const raceEnabled = true
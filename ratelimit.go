@@ -0,0 +1,383 @@
+package stats
+
+// A RateLimitedSink keeps writes to a backend within its quotas:
+//
+//	limited := stats.RateLimited(stackdriver.Sink, stats.RateLimit{WritesPerSecond: 10, PointsPerSecond: 500})
+//	defer limited.Close()
+//	router.Use(stats.Metrics(limited))
+//
+// Writes within the budget go straight through. Writes beyond it are deferred: they're
+// held, coalesced with whatever else is waiting, and written as the budget allows.
+// Coalescing sums counters and merges histograms in the same series, and keeps the last
+// value of gauges, so a burst of traffic costs fewer points rather than more writes.
+// Timers aren't coalesced. If more than MaxDeferred metrics are waiting, further metrics
+// are dropped. Throttling is logged when it starts, and counted in Stats.
+//
+// Deferred writes happen in the background, so their errors are logged rather than
+// returned. Closing the sink writes whatever is waiting; writes after that go straight
+// through, without limits.
+
+import (
+	"context"
+	"github.com/efixler/multierror"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often deferred metrics are considered for writing
+const rateLimitInterval = 50 * time.Millisecond
+
+// RateLimit configures a RateLimitedSink. Zero rates are unlimited.
+type RateLimit struct {
+	WritesPerSecond float64 // Calls to the wrapped sink
+	PointsPerSecond float64 // Metrics written to the wrapped sink
+	Burst           float64 // Budget that can build up, in seconds' worth of each rate (default 1)
+	MaxDeferred     int     // Metrics that can be waiting to be written (default 10000)
+}
+
+// RateLimitStats are the running totals of a RateLimitedSink, in metrics.
+type RateLimitStats struct {
+	Deferred  int64 // Metrics that had to wait for budget
+	Coalesced int64 // Metrics that were merged into another waiting metric
+	Dropped   int64 // Metrics that were dropped because too many were waiting
+	Waiting   int   // Metrics waiting now
+}
+
+// RateLimitedSink is a token-bucket rate limiter in front of a Sink. See the top of ratelimit.go.
+type RateLimitedSink struct {
+	sink        Sink
+	maxDeferred int
+	now         func() time.Time
+
+	mu      sync.Mutex // guards the buckets, the waiting metrics, and closed
+	writes  *tokenBucket
+	points  *tokenBucket
+	waiting Batch
+	index   map[string]int // coalescing key -> position in waiting
+	closed  bool
+
+	deferred  atomic.Int64
+	coalesced atomic.Int64
+	dropped   atomic.Int64
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// RateLimited wraps sink in a RateLimitedSink, which writes deferred metrics in the
+// background until it's closed. The sink's own name translation is applied to what's
+// written to it.
+func RateLimited(sink Sink, limit RateLimit) *RateLimitedSink {
+	if limit.Burst <= 0 {
+		limit.Burst = 1
+	}
+	if limit.MaxDeferred <= 0 {
+		limit.MaxDeferred = 10000
+	}
+	rl := &RateLimitedSink{
+		sink:        withNameTranslation(sink),
+		maxDeferred: limit.MaxDeferred,
+		now:         time.Now,
+		index:       make(map[string]int),
+		done:        make(chan struct{}),
+	}
+	now := rl.now()
+	rl.writes = newTokenBucket(limit.WritesPerSecond, limit.Burst, now)
+	rl.points = newTokenBucket(limit.PointsPerSecond, limit.Burst, now)
+	rl.wg.Add(1)
+	go rl.run()
+	return rl
+}
+
+// Stats returns the throttling totals.
+func (rl *RateLimitedSink) Stats() RateLimitStats {
+	rl.mu.Lock()
+	waiting := len(rl.waiting)
+	rl.mu.Unlock()
+	return RateLimitStats{
+		Deferred:  rl.deferred.Load(),
+		Coalesced: rl.coalesced.Load(),
+		Dropped:   rl.dropped.Load(),
+		Waiting:   waiting,
+	}
+}
+
+func (rl *RateLimitedSink) WriteCounters(ctx context.Context, counters ...*Counter) error {
+	batch := make(Batch, len(counters))
+	for i, c := range counters {
+		batch[i] = c
+	}
+	return rl.WriteBatch(ctx, batch)
+}
+
+func (rl *RateLimitedSink) WriteTimers(ctx context.Context, timers ...*Timer) error {
+	batch := make(Batch, len(timers))
+	for i, t := range timers {
+		batch[i] = t
+	}
+	return rl.WriteBatch(ctx, batch)
+}
+
+func (rl *RateLimitedSink) WriteGauges(ctx context.Context, gauges ...*Gauge) error {
+	batch := make(Batch, len(gauges))
+	for i, g := range gauges {
+		batch[i] = g
+	}
+	return rl.WriteBatch(ctx, batch)
+}
+
+func (rl *RateLimitedSink) WriteHistograms(ctx context.Context, histograms ...*Histogram) error {
+	batch := make(Batch, len(histograms))
+	for i, h := range histograms {
+		batch[i] = h
+	}
+	return rl.WriteBatch(ctx, batch)
+}
+
+// WriteBatch writes the batch now if the budget allows, and defers it otherwise.
+// Deferred writes return nil. Once the sink is closed, batches are written right away.
+func (rl *RateLimitedSink) WriteBatch(ctx context.Context, batch Batch) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	rl.mu.Lock()
+	if rl.closed {
+		rl.mu.Unlock()
+		return WriteBatch(ctx, rl.sink, batch)
+	}
+	now := rl.now()
+	calls := float64(writeCalls(rl.sink, batch))
+	// nothing jumps the queue, so metrics are written in the order they arrive
+	if len(rl.waiting) == 0 && rl.writes.available(now) >= calls && rl.points.available(now) >= float64(len(batch)) {
+		rl.writes.take(calls)
+		rl.points.take(float64(len(batch)))
+		rl.mu.Unlock()
+		return WriteBatch(ctx, rl.sink, batch)
+	}
+	if len(rl.waiting) == 0 {
+		warnf(ctx, "Throttling writes to %T to stay within its rate limits", rl.sink)
+	}
+	for _, m := range batch {
+		rl.deferMetric(m)
+	}
+	rl.mu.Unlock()
+	return nil
+}
+
+// deferMetric adds m to the waiting metrics, coalescing it if possible. It must be
+// called with the lock held.
+func (rl *RateLimitedSink) deferMetric(m Metric) {
+	rl.deferred.Add(1)
+	key, ok := coalesceKey(m)
+	if ok {
+		if i, found := rl.index[key]; found {
+			rl.waiting[i] = coalesce(rl.waiting[i], m)
+			rl.coalesced.Add(1)
+			return
+		}
+	}
+	if len(rl.waiting) >= rl.maxDeferred {
+		rl.dropped.Add(1)
+		return
+	}
+	if ok {
+		rl.index[key] = len(rl.waiting)
+	}
+	rl.waiting = append(rl.waiting, m)
+}
+
+// coalesceKey identifies the series of a metric that can be coalesced
+func coalesceKey(m Metric) (string, bool) {
+	switch m.(type) {
+	case *Counter:
+		return "c|" + seriesKey(m.Name(), tagsOf(m)), true
+	case *Gauge:
+		return "g|" + seriesKey(m.Name(), tagsOf(m)), true
+	case *Histogram:
+		return "h|" + seriesKey(m.Name(), tagsOf(m)), true
+	}
+	return "", false
+}
+
+// coalesce merges next into prev, copying rather than modifying either
+func coalesce(prev, next Metric) Metric {
+	switch p := prev.(type) {
+	case *Counter:
+		return p.merge(next.(*Counter))
+	case *Histogram:
+		h := *p
+		h.observations = append(append([]time.Duration(nil), p.observations...), next.(*Histogram).observations...)
+		h.data = len(h.observations)
+		return &h
+	}
+	return next // gauges: the last value wins
+}
+
+func (rl *RateLimitedSink) run() {
+	defer rl.wg.Done()
+	ticker := time.NewTicker(rateLimitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rl.done:
+			return
+		case <-ticker.C:
+			rl.drain(context.Background(), false)
+		}
+	}
+}
+
+// drain writes as many waiting metrics as the budget allows, or all of them if force is set
+func (rl *RateLimitedSink) drain(ctx context.Context, force bool) error {
+	rl.mu.Lock()
+	if len(rl.waiting) == 0 {
+		rl.mu.Unlock()
+		return nil
+	}
+	n := len(rl.waiting)
+	if !force {
+		now := rl.now()
+		if rl.writes.available(now) < 1 {
+			rl.mu.Unlock()
+			return nil
+		}
+		if points := int(rl.points.available(now)); points < n {
+			n = points
+		}
+		if n == 0 {
+			rl.mu.Unlock()
+			return nil
+		}
+		// a batch that takes more calls than there are tokens goes into debt, so that
+		// the calls after it wait
+		rl.writes.take(float64(writeCalls(rl.sink, rl.waiting[:n])))
+		rl.points.take(float64(n))
+	}
+	batch := rl.waiting[:n:n]
+	rl.waiting = append(Batch(nil), rl.waiting[n:]...)
+	clear(rl.index)
+	for i, m := range rl.waiting {
+		if key, ok := coalesceKey(m); ok {
+			rl.index[key] = i
+		}
+	}
+	rl.mu.Unlock()
+	err := WriteBatch(ctx, rl.sink, batch)
+	if err != nil {
+		reportError(ctx, err, "Error writing deferred metrics to %T", rl.sink)
+	}
+	return err
+}
+
+// Flush waits for the deferred metrics to be written, and then flushes the wrapped
+// sink if it's a Flusher.
+func (rl *RateLimitedSink) Flush(ctx context.Context) error {
+	for {
+		rl.mu.Lock()
+		waiting := len(rl.waiting)
+		rl.mu.Unlock()
+		if waiting == 0 {
+			return FlushSink(ctx, rl.sink)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(rateLimitInterval):
+		}
+	}
+}
+
+// Close stops the background writes, writes whatever is still waiting regardless of
+// the limits, and closes the wrapped sink if it's a Closer. Closing again does nothing
+// more, and returns the same result.
+func (rl *RateLimitedSink) Close() error {
+	rl.closeOnce.Do(func() {
+		rl.mu.Lock()
+		rl.closed = true // nothing more is deferred
+		rl.mu.Unlock()
+		close(rl.done)
+		rl.wg.Wait()
+		me := make(multierror.MultiError, 0)
+		if err := rl.drain(context.Background(), true); err != nil {
+			me = append(me, err)
+		}
+		if err := CloseSink(rl.sink); err != nil {
+			me = append(me, err)
+		}
+		rl.closeErr = me.NilWhenEmpty()
+	})
+	return rl.closeErr
+}
+
+func (rl *RateLimitedSink) Healthy(ctx context.Context) error {
+	return CheckHealth(ctx, rl.sink)
+}
+
+// writeCalls is the number of calls to sink it takes to write the batch. A BatchWriter
+// takes one; other sinks take one for each kind of metric in the batch (see WriteBatch).
+func writeCalls(sink Sink, batch Batch) int {
+	for {
+		ts, ok := sink.(*transformSink)
+		if !ok {
+			break
+		}
+		sink = ts.Sink // transformSinks pass batches on to WriteBatch
+	}
+	if _, ok := sink.(BatchWriter); ok {
+		return 1
+	}
+	_, gauges := sink.(GaugeWriter)
+	var counter, timer, gauge, histogram int
+	for _, m := range batch {
+		switch m.(type) {
+		case *Counter:
+			counter = 1
+		case *Timer:
+			timer = 1
+		case *Gauge:
+			if gauges {
+				gauge = 1
+			}
+		case *Histogram:
+			histogram = 1
+		}
+	}
+	return max(counter+timer+gauge+histogram, 1)
+}
+
+// tokenBucket holds up to burst seconds' worth of tokens, refilled at rate per second.
+// A zero rate is unlimited. tokenBuckets aren't safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	max    float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	max := math.Max(rate*burst, 1) // there has to be room for at least one
+	return &tokenBucket{rate: rate, max: max, tokens: max, last: now}
+}
+
+// available refills the bucket as of now and returns the tokens in it
+func (tb *tokenBucket) available(now time.Time) float64 {
+	if tb.rate <= 0 {
+		return float64(1 << 62)
+	}
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.max {
+		tb.tokens = tb.max
+	}
+	tb.last = now
+	return tb.tokens
+}
+
+func (tb *tokenBucket) take(n float64) {
+	if tb.rate > 0 {
+		tb.tokens -= n
+	}
+}
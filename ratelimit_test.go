@@ -0,0 +1,101 @@
+package stats
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedSink(t *testing.T) {
+	ctx := context.Background()
+	sink := &capableSink{}
+	rl := RateLimited(sink, RateLimit{WritesPerSecond: 1, PointsPerSecond: 2, MaxDeferred: 3})
+	var clock atomic.Int64
+	start := time.Now()
+	rl.mu.Lock()
+	rl.now = func() time.Time { return start.Add(time.Duration(clock.Load())) }
+	rl.writes.last, rl.points.last = start, start
+	rl.mu.Unlock()
+
+	// the first write is within budget
+	rl.WriteCounters(ctx, testCounter("test/a", 1))
+	if len(sink.counters) != 1 {
+		t.Fatalf("Expected the first write to go straight through, got %d counters", len(sink.counters))
+	}
+	// the rest wait, coalescing where they can
+	rl.WriteCounters(ctx, testCounter("test/a", 2), testCounter("test/b", 1))
+	rl.WriteCounters(ctx, testCounter("test/a", 3))
+	g := makeGauge("test/gauge")
+	g.Set(1)
+	rl.WriteGauges(ctx, g)
+	rl.WriteTimers(ctx, &Timer{metric: metric{name: "test/timer", data: 1}})
+	stats := rl.Stats()
+	if len(sink.counters) != 1 || stats.Waiting != 3 || stats.Coalesced != 1 || stats.Dropped != 1 {
+		t.Fatalf("Expected 3 waiting with 1 coalesced and 1 dropped, got %+v", stats)
+	}
+
+	// after a second, there's budget for one write of two points
+	clock.Store(int64(time.Second))
+	rl.drain(ctx, false)
+	if len(sink.counters) != 3 || sink.counters[1].Data() != 5 || len(sink.gauges) != 0 {
+		t.Errorf("Expected test/a (coalesced to 5) and test/b, got %v", sink.counters)
+	}
+	if rl.Stats().Waiting != 1 {
+		t.Errorf("Expected the gauge to still be waiting, got %+v", rl.Stats())
+	}
+	// on close, everything left is written
+	rl.Close()
+	if len(sink.gauges) != 1 {
+		t.Errorf("Expected the gauge to be written on close, got %v", sink.gauges)
+	}
+	// after close, writes go straight through, and closing again is harmless
+	rl.WriteCounters(ctx, testCounter("test/late", 1), testCounter("test/late", 2))
+	if len(sink.counters) != 5 || rl.Stats().Waiting != 0 {
+		t.Errorf("Expected writes after close to go through, got %v", sink.counters)
+	}
+	if err := rl.Close(); err != nil {
+		t.Errorf("Unexpected error closing again: %s", err)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	tb := newTokenBucket(10, 1, now)
+	if tb.available(now) != 10 {
+		t.Errorf("Expected a full bucket to start, got %f", tb.tokens)
+	}
+	tb.take(10)
+	if got := tb.available(now.Add(500 * time.Millisecond)); got != 5 {
+		t.Errorf("Expected 5 tokens after half a second, got %f", got)
+	}
+	if got := tb.available(now.Add(time.Hour)); got != 10 {
+		t.Errorf("Expected the bucket to be capped at 10, got %f", got)
+	}
+	if unlimited := newTokenBucket(0, 1, now); unlimited.available(now) < 1e9 {
+		t.Errorf("Expected a zero rate to be unlimited")
+	}
+}
+
+func TestRateLimitedSinkCountsCalls(t *testing.T) {
+	ctx := context.Background()
+	sink := &recordingSink{}
+	rl := RateLimited(sink, RateLimit{WritesPerSecond: 2})
+	defer rl.Close()
+	rl.mu.Lock()
+	now := time.Now()
+	rl.now = func() time.Time { return now }
+	rl.writes.last = now
+	rl.mu.Unlock()
+
+	// a plain Sink takes a call for the counters and another for the timers
+	mixed := Batch{testCounter("test/counter", 1), &Timer{metric: metric{name: "test/timer", data: 1}}}
+	if calls := writeCalls(rl.sink, mixed); calls != 2 {
+		t.Errorf("Expected 2 calls for a mixed batch, got %d", calls)
+	}
+	rl.WriteBatch(ctx, mixed)
+	rl.WriteCounters(ctx, testCounter("test/counter", 1))
+	if len(sink.counters) != 1 || len(sink.timers) != 1 || rl.Stats().Waiting != 1 {
+		t.Errorf("Expected the mixed batch to use up the budget, got %+v", rl.Stats())
+	}
+}
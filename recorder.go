@@ -0,0 +1,50 @@
+package stats
+
+import (
+	"context"
+)
+
+// Recorder is the object form of the package-level recording functions. It lets
+// services take their stats collector as a dependency instead of looking it up
+// in the request context on every call, which also makes them easy to test:
+// pass NopRecorder, or a fake of your own, in place of the real thing.
+//
+//	type userService struct {
+//	    stats stats.Recorder
+//	}
+//
+//	func (s *userService) Add(u *User) error {
+//	    s.stats.Increment("add_user")
+//	    ...
+//	}
+//
+// The Recorder for a request is obtained with FromContext. Errors returned by
+// Recorder methods are the same as for their package-level counterparts.
+type Recorder interface {
+	Increment(bucket string) error
+	StartTimer(bucket string) error
+	FinishTimer(bucket string) error
+}
+
+type nopRecorder struct{}
+
+func (nopRecorder) Increment(bucket string) error   { return nil }
+func (nopRecorder) StartTimer(bucket string) error  { return nil }
+func (nopRecorder) FinishTimer(bucket string) error { return nil }
+
+// NopRecorder discards everything recorded into it. It's useful as a default
+// dependency and in unit tests.
+var NopRecorder Recorder = nopRecorder{}
+
+// FromContext returns the Recorder attached to the request context by the Metrics
+// middleware. If the context hasn't been set up for metrics, NopRecorder is returned,
+// so the result is always safe to use. Once the request is over, the Recorder's methods
+// return RequestMetricsNotInitted.
+func FromContext(ctx context.Context) Recorder {
+	if ref, ok := ctx.Value(requestStatsKey).(*statsRef); ok {
+		if ref.live() {
+			return ref
+		}
+	}
+	return NopRecorder
+}
@@ -0,0 +1,220 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	UndeclaredMetric = errors.New("Metric has not been declared in the registry")
+	WrongMetricKind  = errors.New("Metric was declared as a different kind")
+	NoMetricKind     = errors.New("Metric declarations need a kind")
+	AlreadyDeclared  = errors.New("A different metric with that name has already been declared")
+	UndeclaredTag    = errors.New("Tag has not been declared for the metric")
+)
+
+// Kind is the type of data a metric holds.
+type Kind int
+
+const (
+	KindCounter Kind = iota + 1
+	KindTimer
+	KindGauge
+	KindHistogram
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindCounter:
+		return "counter"
+	case KindTimer:
+		return "timer"
+	case KindGauge:
+		return "gauge"
+	case KindHistogram:
+		return "histogram"
+	}
+	return "unknown"
+}
+
+// Descriptor is the metadata for a declared metric. Sinks can use descriptors to
+// provision metrics in their backend, see Registry.Descriptors.
+type Descriptor struct {
+	Name        string
+	Kind        Kind
+	Unit        string    // UCUM-style unit, e.g. "1" for counts, "ms" for times
+	Description string    // Human readable description
+	Tags        []string  // Tag keys the metric may carry
+	Buckets     []float64 // Upper bounds of the buckets, for histograms
+}
+
+// AllowsTag is true if key is one of the descriptor's declared tags.
+func (d Descriptor) AllowsTag(key string) bool {
+	for _, t := range d.Tags {
+		if t == key {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultUnit is the unit used for a kind of metric when a descriptor doesn't specify one.
+func (k Kind) DefaultUnit() string {
+	switch k {
+	case KindTimer:
+		return "ms"
+	}
+	return "1"
+}
+
+// Registry holds metric declarations. Declaring metrics is optional; in its default
+// mode a registry is purely informational. A strict registry rejects any metric
+// that hasn't been declared, as well as metrics that are used as a different kind
+// than they were declared as. The tags of declared metrics are held to their
+// descriptors' Tags as well: tags added by the decorators in this package that
+// haven't been declared are stripped, and logged (once per metric and tag).
+type Registry struct {
+	mu          sync.RWMutex
+	descriptors map[string]Descriptor
+	strict      atomic.Bool
+	stripped    sync.Map // "name tag" -> struct{}, so each one is only logged once
+}
+
+// DefaultRegistry is the registry consulted by the recording APIs.
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{descriptors: make(map[string]Descriptor)}
+}
+
+// Declare adds d to the registry. The name is checked by the current NamePolicy, and
+// the metric is declared under the name that the policy returns. Redeclaring a metric
+// with an identical descriptor is a no-op; redeclaring it differently returns AlreadyDeclared.
+func (r *Registry) Declare(d Descriptor) error {
+	var err error
+	if d.Name, err = metricName(d.Name); err != nil {
+		return err
+	} else if d.Kind == 0 {
+		return NoMetricKind
+	}
+	if d.Unit == "" {
+		d.Unit = d.Kind.DefaultUnit()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.descriptors[d.Name]; ok {
+		if !sameDescriptor(existing, d) {
+			return AlreadyDeclared
+		}
+		return nil
+	}
+	r.descriptors[d.Name] = d
+	return nil
+}
+
+// Lookup the descriptor for the named metric.
+func (r *Registry) Lookup(name string) (Descriptor, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	d, ok := r.descriptors[name]
+	return d, ok
+}
+
+// Descriptors returns all of the declared metrics, sorted by name.
+func (r *Registry) Descriptors() []Descriptor {
+	r.mu.RLock()
+	ds := make([]Descriptor, 0, len(r.descriptors))
+	for _, d := range r.descriptors {
+		ds = append(ds, d)
+	}
+	r.mu.RUnlock()
+	sort.Slice(ds, func(i, j int) bool { return ds[i].Name < ds[j].Name })
+	return ds
+}
+
+// SetStrict turns rejection of undeclared metrics on or off.
+func (r *Registry) SetStrict(strict bool) {
+	r.strict.Store(strict)
+}
+
+// Strict reports whether the registry rejects undeclared metrics.
+func (r *Registry) Strict() bool {
+	return r.strict.Load()
+}
+
+// Check whether a metric may be recorded. Non-strict registries allow anything.
+func (r *Registry) Check(name string, kind Kind) error {
+	if !r.strict.Load() {
+		return nil
+	}
+	d, ok := r.Lookup(name)
+	if !ok {
+		return UndeclaredMetric
+	} else if d.Kind != kind {
+		return WrongMetricKind
+	}
+	return nil
+}
+
+// CheckTags whether a metric may carry tags. Non-strict registries allow anything, and
+// so do strict ones for metrics that haven't been declared (see Check).
+func (r *Registry) CheckTags(name string, tags Tags) error {
+	if len(tags) == 0 || !r.strict.Load() {
+		return nil
+	}
+	d, ok := r.Lookup(name)
+	if !ok {
+		return nil
+	}
+	for key := range tags {
+		if !d.AllowsTag(key) {
+			return UndeclaredTag
+		}
+	}
+	return nil
+}
+
+// declaredTags returns tags without the keys that CheckTags would reject. tags isn't
+// modified.
+func (r *Registry) declaredTags(name string, tags Tags) Tags {
+	if r.CheckTags(name, tags) == nil {
+		return tags
+	}
+	d, _ := r.Lookup(name)
+	declared := make(Tags, len(tags))
+	for key, value := range tags {
+		if d.AllowsTag(key) {
+			declared[key] = value
+		} else if _, warned := r.stripped.LoadOrStore(name+" "+key, struct{}{}); !warned {
+			warnf(context.Background(), "Stripping undeclared tag %s from metric %s", key, name)
+		}
+	}
+	return declared
+}
+
+// Declare a metric in the DefaultRegistry.
+func Declare(d Descriptor) error {
+	return DefaultRegistry.Declare(d)
+}
+
+func sameDescriptor(a, b Descriptor) bool {
+	if a.Name != b.Name || a.Kind != b.Kind || a.Unit != b.Unit || a.Description != b.Description {
+		return false
+	} else if len(a.Tags) != len(b.Tags) || len(a.Buckets) != len(b.Buckets) {
+		return false
+	}
+	for i := range a.Tags {
+		if a.Tags[i] != b.Tags[i] {
+			return false
+		}
+	}
+	for i := range a.Buckets {
+		if a.Buckets[i] != b.Buckets[i] {
+			return false
+		}
+	}
+	return true
+}
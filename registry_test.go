@@ -0,0 +1,98 @@
+package stats
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Declare(Descriptor{Name: "cache.hit"}); err != NoMetricKind {
+		t.Errorf("Expected %s, got %v", NoMetricKind, err)
+	}
+	if err := r.Declare(Descriptor{Name: "bad&name", Kind: KindCounter}); err != IllegalMetricName {
+		t.Errorf("Expected %s, got %v", IllegalMetricName, err)
+	}
+	hit := Descriptor{Name: "cache.hit", Kind: KindCounter, Description: "Cache hits"}
+	if err := r.Declare(hit); err != nil {
+		t.Fatalf("Unexpected error declaring %s: %s", hit.Name, err)
+	}
+	if err := r.Declare(hit); err != nil {
+		t.Errorf("Identical redeclaration should be allowed, got %s", err)
+	}
+	if err := r.Declare(Descriptor{Name: "cache.hit", Kind: KindTimer}); err != AlreadyDeclared {
+		t.Errorf("Expected %s, got %v", AlreadyDeclared, err)
+	}
+	if d, ok := r.Lookup("cache.hit"); !ok || d.Unit != "1" {
+		t.Errorf("Expected declared counter with default unit, got %+v", d)
+	}
+	if err := r.Check("not/declared", KindCounter); err != nil {
+		t.Errorf("Non-strict registry should allow anything, got %s", err)
+	}
+	r.SetStrict(true)
+	checks := []struct {
+		name string
+		kind Kind
+		err  error
+	}{
+		{"cache.hit", KindCounter, nil},
+		{"cache.hit", KindTimer, WrongMetricKind},
+		{"not/declared", KindCounter, UndeclaredMetric},
+	}
+	for _, c := range checks {
+		if err := r.Check(c.name, c.kind); err != c.err {
+			t.Errorf("Check %s as %s: expected %v, got %v", c.name, c.kind, c.err, err)
+		}
+	}
+}
+
+func TestStrictDefaultRegistry(t *testing.T) {
+	defer func(r *Registry) { DefaultRegistry = r }(DefaultRegistry)
+	DefaultRegistry = NewRegistry()
+	DefaultRegistry.Declare(Descriptor{Name: "declared/counter", Kind: KindCounter})
+	DefaultRegistry.SetStrict(true)
+	ctx := requestContextUsingMetrics()
+	if err := Increment(ctx, "declared/counter"); err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+	if err := Increment(ctx, "undeclared/counter"); err != UndeclaredMetric {
+		t.Errorf("Expected %s, got %v", UndeclaredMetric, err)
+	}
+	if err := StartTimer(ctx, "declared/counter"); err != WrongMetricKind {
+		t.Errorf("Expected %s, got %v", WrongMetricKind, err)
+	}
+}
+
+func TestStrictRegistryTags(t *testing.T) {
+	defer func(r *Registry) { DefaultRegistry = r }(DefaultRegistry)
+	DefaultRegistry = NewRegistry()
+	DefaultRegistry.Declare(Descriptor{Name: "declared/counter", Kind: KindCounter, Tags: []string{"route"}})
+	tags := Tags{"route": "users", "user": "12"}
+	if err := DefaultRegistry.CheckTags("declared/counter", tags); err != nil {
+		t.Errorf("Non-strict registry should allow any tags, got %s", err)
+	}
+	DefaultRegistry.SetStrict(true)
+	if err := DefaultRegistry.CheckTags("declared/counter", tags); err != UndeclaredTag {
+		t.Errorf("Expected %s, got %v", UndeclaredTag, err)
+	}
+	if err := DefaultRegistry.CheckTags("declared/counter", Tags{"route": "users"}); err != nil {
+		t.Errorf("Expected declared tags to be allowed, got %s", err)
+	}
+
+	sink := &recordingSink{}
+	tagged := Metrics(sink, WithTags(tags))
+	serve(tagged, func(w http.ResponseWriter, r *http.Request) {
+		Increment(r.Context(), "declared/counter")
+	})
+	waitFor(t, func() bool {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		return len(sink.counters) == 1
+	})
+	if got := sink.counters[0].Tags(); len(got) != 1 || got["route"] != "users" {
+		t.Errorf("Expected the undeclared tag to be stripped, got %v", got)
+	}
+	if len(tags) != 2 {
+		t.Errorf("The original tags shouldn't be modified, got %v", tags)
+	}
+}
@@ -0,0 +1,102 @@
+package stats
+
+// The middleware that reports on responses (Server-Timing and so on) wraps the
+// http.ResponseWriter to see the status and size of the response, and to add headers
+// at the last moment before they're sent.
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+type responseWriter struct {
+	http.ResponseWriter
+	status       int
+	bytes        int64
+	wroteHeader  bool
+	beforeHeader []func(h http.Header) // called just before the headers are sent
+}
+
+// wrapResponse returns w as a *responseWriter, wrapping it if it isn't one already, so
+// that stacked middleware shares one wrapper
+func wrapResponse(w http.ResponseWriter) *responseWriter {
+	if rw, ok := w.(*responseWriter); ok {
+		return rw
+	}
+	return &responseWriter{ResponseWriter: w}
+}
+
+// onHeader adds f to the functions called just before the headers are sent. If they've
+// already been sent, it does nothing.
+func (rw *responseWriter) onHeader(f func(h http.Header)) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.beforeHeader = append(rw.beforeHeader, f)
+}
+
+// WriteHeader sends the headers with status, once. Informational (1xx) responses other
+// than 101 Switching Protocols can come before the final one, so they're passed
+// through without counting as the response's status.
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.wroteHeader {
+		return
+	}
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		rw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	rw.wroteHeader = true
+	rw.status = status
+	for _, f := range rw.beforeHeader {
+		f(rw.Header())
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+// finish sends the headers, if the handler didn't write anything
+func (rw *responseWriter) finish() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+// Status of the response; 200 if it hasn't been written yet
+func (rw *responseWriter) Status() int {
+	if rw.status == 0 {
+		return http.StatusOK
+	}
+	return rw.status
+}
+
+func (rw *responseWriter) Flush() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := rw.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("Response doesn't support hijacking")
+}
+
+// Unwrap lets http.ResponseController get at the original
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -0,0 +1,459 @@
+package stats
+
+// A RetrySink retries writes that fail for reasons that might go away, like timeouts,
+// rate limiting (HTTP 429) and server errors (HTTP 5xx):
+//
+//	router.Use(stats.Metrics(stats.Retry(stackdriver.Sink, stats.RetryPolicy{})))
+//
+// Errors are classified with IsRetryable. Sinks can make the call themselves by
+// returning errors that implement Retryable (MarkRetryable makes one). Sinks that write
+// a batch piecemeal should wrap each failure in a MetricError, so that only the metrics
+// that failed are retried; otherwise the whole batch is retried, and metrics that were
+// written the first time may be written twice.
+//
+// The first attempt happens in the goroutine doing the write. Anything worth retrying
+// is then handed to the RetrySink's own goroutine, so the write returns right away
+// instead of waiting out the backoff; errors from the retries are logged, since there's
+// no one left to return them to. Retries are bounded in time by the policy's MaxElapsed,
+// and in memory by MaxPending: when too many metrics are already waiting on retries, a
+// failed write is given up on right away. Close makes one last attempt at everything
+// still waiting.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/efixler/multierror"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	RetryLimitExceeded = errors.New("Too many metrics are awaiting retry; not retrying")
+	RetrySinkClosed    = errors.New("RetrySink is closed")
+)
+
+// Retryable is implemented by errors that know whether the write that caused them
+// could succeed if it were tried again.
+type Retryable interface {
+	error
+	Retryable() bool
+}
+
+type retryableError struct {
+	err       error
+	retryable bool
+}
+
+func (e *retryableError) Error() string   { return e.err.Error() }
+func (e *retryableError) Unwrap() error   { return e.err }
+func (e *retryableError) Retryable() bool { return e.retryable }
+
+// MarkRetryable wraps err with the verdict of whether a retry could succeed.
+func MarkRetryable(err error, retryable bool) error {
+	if err == nil {
+		return nil
+	}
+	return &retryableError{err: err, retryable: retryable}
+}
+
+// RetryableStatus is the usual classification of HTTP status codes: request timeouts,
+// rate limiting, and server errors are worth retrying.
+func RetryableStatus(code int) bool {
+	return code == 408 || code == 429 || code >= 500
+}
+
+// IsRetryable decides whether err is worth retrying. Errors implementing Retryable
+// decide for themselves; otherwise timeouts are retryable and everything else is
+// permanent. A MultiError is retryable if all of its errors are.
+func IsRetryable(err error) bool {
+	if me, ok := err.(multierror.MultiError); ok {
+		for _, e := range me {
+			if !IsRetryable(e) {
+				return false
+			}
+		}
+		return len(me) > 0
+	}
+	var r Retryable
+	if errors.As(err, &r) {
+		return r.Retryable()
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// MetricError is the failure to write a single metric. Sinks that write metrics one at
+// a time can return a MultiError of these to let a RetrySink retry just the failures.
+type MetricError struct {
+	Metric Metric
+	Err    error
+}
+
+func (e *MetricError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Metric.Name(), e.Err)
+}
+
+func (e *MetricError) Unwrap() error {
+	return e.Err
+}
+
+// RetryPolicy configures a RetrySink. Zero fields get the defaults noted.
+type RetryPolicy struct {
+	MaxAttempts    int           // Attempts per write, including the first (default 5)
+	InitialBackoff time.Duration // Wait before the first retry (default 100ms)
+	MaxBackoff     time.Duration // Longest wait between attempts (default 10s)
+	MaxElapsed     time.Duration // Time after which a write is given up on (default 1m)
+	MaxPending     int           // Metrics that can be awaiting retry at once (default 10000)
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 5
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = 100 * time.Millisecond
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = 10 * time.Second
+	}
+	if p.MaxElapsed <= 0 {
+		p.MaxElapsed = time.Minute
+	}
+	if p.MaxPending <= 0 {
+		p.MaxPending = 10000
+	}
+	return p
+}
+
+// backoff is the wait before retry n (starting at 1): exponential, capped, and
+// jittered over its upper half so that failed writes don't retry in lockstep
+func (p RetryPolicy) backoff(n int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < n && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int64N(half+1))
+}
+
+// RetrySink retries failed writes to the Sink it wraps. See the top of retry.go.
+type RetrySink struct {
+	sink    Sink
+	policy  RetryPolicy
+	pending atomic.Int64
+	retries atomic.Int64
+	dropped atomic.Int64
+
+	mu      sync.Mutex // guards waiting and closed
+	waiting []*retryJob
+	closed  bool
+	wake    chan struct{} // nudges the worker when a job is added
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// a retryJob is a set of metrics waiting for their next attempt
+type retryJob struct {
+	ctx      context.Context
+	batch    Batch
+	err      error // from the last attempt
+	attempts int
+	deadline time.Time
+	due      time.Time
+}
+
+// Retry wraps sink in a RetrySink. The sink's own name translation is applied to what's
+// written to it. The RetrySink runs a goroutine until it's closed.
+func Retry(sink Sink, policy RetryPolicy) *RetrySink {
+	rs := &RetrySink{
+		sink:    withNameTranslation(sink),
+		policy:  policy.withDefaults(),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go rs.run()
+	return rs
+}
+
+// Retries is the number of retried writes so far.
+func (rs *RetrySink) Retries() int64 {
+	return rs.retries.Load()
+}
+
+// GivenUp is the number of metrics that couldn't be written after retrying, or that
+// weren't retried because of the MaxPending limit.
+func (rs *RetrySink) GivenUp() int64 {
+	return rs.dropped.Load()
+}
+
+func (rs *RetrySink) WriteCounters(ctx context.Context, counters ...*Counter) error {
+	batch := make(Batch, len(counters))
+	for i, c := range counters {
+		batch[i] = c
+	}
+	return rs.WriteBatch(ctx, batch)
+}
+
+func (rs *RetrySink) WriteTimers(ctx context.Context, timers ...*Timer) error {
+	batch := make(Batch, len(timers))
+	for i, t := range timers {
+		batch[i] = t
+	}
+	return rs.WriteBatch(ctx, batch)
+}
+
+func (rs *RetrySink) WriteGauges(ctx context.Context, gauges ...*Gauge) error {
+	batch := make(Batch, len(gauges))
+	for i, g := range gauges {
+		batch[i] = g
+	}
+	return rs.WriteBatch(ctx, batch)
+}
+
+func (rs *RetrySink) WriteHistograms(ctx context.Context, histograms ...*Histogram) error {
+	batch := make(Batch, len(histograms))
+	for i, h := range histograms {
+		batch[i] = h
+	}
+	return rs.WriteBatch(ctx, batch)
+}
+
+// WriteBatch writes the batch, and queues whatever failed and is worth retrying. The
+// error returned covers the metrics that won't be retried. Retries happen with a copy
+// of ctx that isn't canceled along with it, since they may well outlast the request.
+func (rs *RetrySink) WriteBatch(ctx context.Context, batch Batch) error {
+	err := WriteBatch(ctx, rs.sink, batch)
+	if err == nil {
+		return nil
+	}
+	retry, failed, me := splitFailures(batch, err)
+	rs.dropped.Add(int64(len(failed)))
+	if len(retry) == 0 {
+		return me.NilWhenEmpty()
+	}
+	n := int64(len(retry))
+	if rs.pending.Add(n) > int64(rs.policy.MaxPending) {
+		rs.pending.Add(-n)
+		rs.dropped.Add(n)
+		return append(me, err, RetryLimitExceeded)
+	}
+	now := time.Now()
+	job := &retryJob{ctx: context.WithoutCancel(ctx), batch: retry, err: err, attempts: 1, deadline: now.Add(rs.policy.MaxElapsed)}
+	if !rs.schedule(job, now) {
+		rs.pending.Add(-n)
+		rs.dropped.Add(n)
+		return append(me, err)
+	}
+	return me.NilWhenEmpty()
+}
+
+// schedule queues the job's next attempt, unless it's out of attempts or time, or
+// the sink is closed
+func (rs *RetrySink) schedule(job *retryJob, now time.Time) bool {
+	if job.attempts >= rs.policy.MaxAttempts {
+		return false
+	}
+	wait := rs.policy.backoff(job.attempts)
+	if now.Add(wait).After(job.deadline) {
+		return false
+	}
+	job.due = now.Add(wait)
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.closed {
+		return false
+	}
+	rs.waiting = append(rs.waiting, job)
+	select {
+	case rs.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// run retries the jobs as they come due, until the sink is closed
+func (rs *RetrySink) run() {
+	defer close(rs.stopped)
+	for {
+		due, next := rs.takeDue(time.Now())
+		for _, job := range due {
+			rs.retry(job)
+		}
+		if len(due) > 0 {
+			continue // the retries took time, so check again
+		}
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			timeout = timer.C
+		}
+		select {
+		case <-rs.wake:
+		case <-timeout:
+		case <-rs.stop:
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// takeDue removes the jobs that are due from the queue, and returns them along with
+// when the next of the rest is due
+func (rs *RetrySink) takeDue(now time.Time) (due []*retryJob, next time.Time) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	waiting := rs.waiting[:0]
+	for _, job := range rs.waiting {
+		if !job.due.After(now) {
+			due = append(due, job)
+			continue
+		} else if next.IsZero() || job.due.Before(next) {
+			next = job.due
+		}
+		waiting = append(waiting, job)
+	}
+	clear(rs.waiting[len(waiting):])
+	rs.waiting = waiting
+	return due, next
+}
+
+// retry makes the job's next attempt, and queues whatever's still worth retrying
+func (rs *RetrySink) retry(job *retryJob) {
+	rs.retries.Add(1)
+	job.attempts++
+	n := int64(len(job.batch))
+	err := WriteBatch(job.ctx, rs.sink, job.batch)
+	if err == nil {
+		rs.pending.Add(-n)
+		return
+	}
+	retry, failed, errs := splitFailures(job.batch, err)
+	rs.pending.Add(int64(len(retry)) - n) // the rest were written, or failed for good
+	rs.dropped.Add(int64(len(failed)))
+	if len(errs) > 0 {
+		reportError(job.ctx, errs, "Giving up on %d metrics that can't be written", len(failed))
+	}
+	if len(retry) == 0 {
+		return
+	}
+	job.batch, job.err = retry, err
+	if !rs.schedule(job, time.Now()) {
+		rs.giveUp(job)
+	}
+}
+
+func (rs *RetrySink) giveUp(job *retryJob) {
+	n := int64(len(job.batch))
+	rs.pending.Add(-n)
+	rs.dropped.Add(n)
+	reportError(job.ctx, job.err, "Giving up on %d metrics after %d attempts", n, job.attempts)
+}
+
+// splitFailures works out what to do with the batch after err: the metrics to retry,
+// and the metrics that failed for good along with their errors. Each of err's errors
+// is classified on its own. MetricErrors decide for their metric; any other error
+// covers the whole batch, so a permanent one fails every metric, and a retryable one
+// retries every metric that didn't fail for good.
+func splitFailures(batch Batch, err error) (retry Batch, failed Batch, errs multierror.MultiError) {
+	errs = make(multierror.MultiError, 0)
+	retryAll := false
+	for _, e := range flatten(err) {
+		var me *MetricError
+		if !errors.As(e, &me) {
+			if !IsRetryable(e) {
+				return nil, batch, append(errs, e)
+			}
+			retryAll = true
+		} else if IsRetryable(me.Err) {
+			retry = append(retry, me.Metric)
+		} else {
+			failed = append(failed, me.Metric)
+			errs = append(errs, e)
+		}
+	}
+	if retryAll {
+		retry = retry[:0]
+		for _, m := range batch {
+			if !containsMetric(failed, m) {
+				retry = append(retry, m)
+			}
+		}
+	}
+	return retry, failed, errs
+}
+
+func containsMetric(batch Batch, m Metric) bool {
+	for _, b := range batch {
+		if b == m {
+			return true
+		}
+	}
+	return false
+}
+
+// flatten nested MultiErrors into one list
+func flatten(err error) []error {
+	me, ok := err.(multierror.MultiError)
+	if !ok {
+		return []error{err}
+	}
+	errs := make([]error, 0, len(me))
+	for _, e := range me {
+		errs = append(errs, flatten(e)...)
+	}
+	return errs
+}
+
+func (rs *RetrySink) Flush(ctx context.Context) error {
+	return FlushSink(ctx, rs.sink)
+}
+
+// Close stops the retries, makes one last attempt at everything that was waiting on
+// one, and then closes the wrapped sink if it's a Closer. Writes after Close aren't
+// retried.
+func (rs *RetrySink) Close() error {
+	rs.mu.Lock()
+	if rs.closed {
+		rs.mu.Unlock()
+		return RetrySinkClosed
+	}
+	rs.closed = true
+	waiting := rs.waiting
+	rs.waiting = nil
+	rs.mu.Unlock()
+	close(rs.stop)
+	<-rs.stopped
+
+	me := make(multierror.MultiError, 0)
+	for _, job := range waiting {
+		rs.retries.Add(1)
+		n := int64(len(job.batch))
+		rs.pending.Add(-n)
+		if err := WriteBatch(job.ctx, rs.sink, job.batch); err != nil {
+			retry, failed, _ := splitFailures(job.batch, err)
+			rs.dropped.Add(int64(len(retry) + len(failed)))
+			me = append(me, err)
+		}
+	}
+	if err := CloseSink(rs.sink); err != nil {
+		me = append(me, err)
+	}
+	return me.NilWhenEmpty()
+}
+
+func (rs *RetrySink) Healthy(ctx context.Context) error {
+	return CheckHealth(ctx, rs.sink)
+}
@@ -0,0 +1,189 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"github.com/efixler/multierror"
+	"testing"
+	"time"
+)
+
+// flakySink fails the first failures writes with err, and records the rest. If
+// perMetric is set, only the first metric of each failed write fails.
+type flakySink struct {
+	recordingSink
+	failures  int
+	err       error
+	perMetric bool
+	calls     int
+}
+
+func (fs *flakySink) WriteCounters(ctx context.Context, counters ...*Counter) error {
+	fs.mu.Lock()
+	fs.calls++
+	fail := fs.failures > 0
+	fs.failures--
+	fs.mu.Unlock()
+	if !fail {
+		return fs.recordingSink.WriteCounters(ctx, counters...)
+	} else if !fs.perMetric {
+		return fs.err
+	}
+	fs.recordingSink.WriteCounters(ctx, counters[1:]...)
+	return multierror.MultiError{&MetricError{Metric: counters[0], Err: fs.err}}
+}
+
+var fastRetries = RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+
+func (fs *flakySink) written() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return len(fs.counters)
+}
+
+func (fs *flakySink) attempts() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.calls
+}
+
+func TestRetrySink(t *testing.T) {
+	ctx := context.Background()
+	flaky := &flakySink{failures: 2, err: MarkRetryable(errors.New("503"), true)}
+	rs := Retry(flaky, fastRetries)
+	defer rs.Close()
+	if err := rs.WriteCounters(ctx, testCounter("test/counter", 1)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	waitFor(t, func() bool { return flaky.written() == 1 })
+	if flaky.attempts() != 3 || rs.Retries() != 2 {
+		t.Errorf("Expected 3 calls and 2 retries, got %d and %d", flaky.attempts(), rs.Retries())
+	}
+
+	permanent := &flakySink{failures: 1, err: MarkRetryable(errors.New("400"), false)}
+	rs = Retry(permanent, fastRetries)
+	defer rs.Close()
+	if err := rs.WriteCounters(ctx, testCounter("test/counter", 1)); err == nil {
+		t.Errorf("Expected an error")
+	}
+	if permanent.calls != 1 || rs.GivenUp() != 1 {
+		t.Errorf("Permanent errors shouldn't be retried, got %d calls", permanent.calls)
+	}
+
+	errs := make(chan error, 1)
+	down := &flakySink{failures: 100, err: context.DeadlineExceeded}
+	rs = Retry(down, fastRetries)
+	defer rs.Close()
+	ctx = pipelineToContext(ctx, newPipeline([]Option{WithErrorHandler(func(ctx context.Context, err error) { errs <- err })}))
+	if err := rs.WriteCounters(ctx, testCounter("test/counter", 1)); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	waitFor(t, func() bool { return rs.GivenUp() == 1 })
+	if down.attempts() != 5 {
+		t.Errorf("Expected 5 attempts, got %d", down.attempts())
+	}
+	select {
+	case err := <-errs:
+		if pe, ok := err.(*PipelineError); !ok || !hasError(pe.Err, context.DeadlineExceeded) {
+			t.Errorf("Expected the last failure to be reported, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Giving up wasn't reported")
+	}
+}
+
+func TestRetrySinkDoesNotBlock(t *testing.T) {
+	flaky := &flakySink{failures: 1, err: MarkRetryable(errors.New("503"), true)}
+	rs := Retry(flaky, RetryPolicy{InitialBackoff: time.Hour, MaxBackoff: time.Hour, MaxElapsed: 2 * time.Hour})
+	start := time.Now()
+	if err := rs.WriteCounters(context.Background(), testCounter("test/counter", 1)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Write waited %s for its retry", elapsed)
+	}
+	if flaky.written() != 0 {
+		t.Fatal("Retry happened early")
+	}
+	// closing makes a last attempt
+	if err := rs.Close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if flaky.written() != 1 || rs.Retries() != 1 {
+		t.Errorf("Expected Close to retry the counter, got %d written and %d retries", flaky.written(), rs.Retries())
+	}
+	if err := rs.Close(); err != RetrySinkClosed {
+		t.Errorf("Expected RetrySinkClosed, got %v", err)
+	}
+}
+
+func TestRetrySinkRetriesOnlyFailedMetrics(t *testing.T) {
+	flaky := &flakySink{failures: 1, err: MarkRetryable(errors.New("429"), true), perMetric: true}
+	rs := Retry(flaky, fastRetries)
+	defer rs.Close()
+	err := rs.WriteCounters(context.Background(), testCounter("test/a", 1), testCounter("test/b", 1))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	waitFor(t, func() bool { return flaky.written() == 2 })
+	if flaky.counters[0].Name() != "test/b" || flaky.counters[1].Name() != "test/a" {
+		t.Errorf("Expected test/b and then a retried test/a, got %v", flaky.counters)
+	}
+}
+
+func TestRetrySinkMaxPending(t *testing.T) {
+	down := &flakySink{failures: 100, err: context.DeadlineExceeded}
+	rs := Retry(down, RetryPolicy{InitialBackoff: 20 * time.Millisecond, MaxAttempts: 2, MaxPending: 1})
+	defer rs.Close()
+	if err := rs.WriteCounters(context.Background(), testCounter("test/counter", 1)); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := rs.WriteCounters(context.Background(), testCounter("test/counter", 1)); !hasError(err, RetryLimitExceeded) {
+		t.Errorf("Expected the second write to skip retries, got %v", err)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{errors.New("plain"), false},
+		{context.DeadlineExceeded, true},
+		{MarkRetryable(errors.New("500"), RetryableStatus(500)), true},
+		{MarkRetryable(errors.New("404"), RetryableStatus(404)), false},
+		{&MetricError{Metric: makeCounter("test/counter"), Err: context.DeadlineExceeded}, true},
+	}
+	for _, test := range tests {
+		if IsRetryable(test.err) != test.retryable {
+			t.Errorf("%s: expected retryable=%t", test.err, test.retryable)
+		}
+	}
+}
+
+func TestSplitFailures(t *testing.T) {
+	a, b, c := testCounter("test/a", 1), testCounter("test/b", 1), testCounter("test/c", 1)
+	batch := Batch{a, b, c}
+	busy := MarkRetryable(errors.New("503"), true)
+	rejected := MarkRetryable(errors.New("400"), false)
+
+	// one metric rejected and one to retry: the rejection isn't retried
+	err := multierror.MultiError{&MetricError{Metric: a, Err: rejected}, &MetricError{Metric: b, Err: busy}}
+	retry, failed, errs := splitFailures(batch, err)
+	if len(retry) != 1 || retry[0] != b || len(failed) != 1 || failed[0] != a || len(errs) != 1 {
+		t.Errorf("Expected to retry test/b and fail test/a, got %v, %v and %v", retry, failed, errs)
+	}
+
+	// a retryable batch-wide error alongside a rejected metric retries the rest
+	err = multierror.MultiError{&MetricError{Metric: a, Err: rejected}, busy}
+	retry, failed, _ = splitFailures(batch, err)
+	if len(retry) != 2 || retry[0] != b || retry[1] != c || len(failed) != 1 {
+		t.Errorf("Expected to retry test/b and test/c, got %v and %v", retry, failed)
+	}
+
+	// a permanent batch-wide error fails everything
+	err = multierror.MultiError{&MetricError{Metric: a, Err: busy}, rejected}
+	if retry, failed, _ = splitFailures(batch, err); len(retry) != 0 || len(failed) != 3 {
+		t.Errorf("Expected the whole batch to fail, got %v and %v", retry, failed)
+	}
+}
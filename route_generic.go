@@ -0,0 +1,13 @@
+//go:build !go1.23
+
+package stats
+
+import (
+	"net/http"
+)
+
+// requestRoute is the request's path. Requests don't carry the ServeMux pattern that
+// matched them before Go 1.23.
+func requestRoute(r *http.Request) string {
+	return r.URL.Path
+}
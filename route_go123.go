@@ -0,0 +1,15 @@
+//go:build go1.23
+
+package stats
+
+import (
+	"net/http"
+)
+
+// requestRoute is the ServeMux pattern that matched the request, or its path
+func requestRoute(r *http.Request) string {
+	if r.Pattern != "" {
+		return r.Pattern
+	}
+	return r.URL.Path
+}
@@ -0,0 +1,312 @@
+package stats
+
+// Rules let operators control which metrics leave the process, and what they look
+// like when they do, without code changes. Rules are applied by a RuleSink, which
+// sits between the request daemon and your Sink:
+//
+//	rs := stats.ApplyRules(stackdriver.Sink, nil)
+//	if err := rs.Watch(ctx, "/etc/myapp/stats-rules.yaml", 10*time.Second); err != nil {
+//	    ...
+//	}
+//	router.Use(stats.Metrics(rs))
+//
+// A rules file looks like this (JSON works too, with the same field names):
+//
+//	allow: ['^api[./]']              # if present, only names matching one of these are sent
+//	deny: ['^api[./]debug[./]']      # names matching any of these are never sent
+//	rules:
+//	  - match: '^api\.(\w+)\.(\w+)\.latency$'
+//	    action: rename
+//	    name: 'api.latency'
+//	  - match: '^api\.latency$'
+//	    action: tag
+//	    tags: {service: 'users'}
+//	  - match: '^api\.'
+//	    action: untag
+//	    remove: ['host']
+//	  - match: '\.tmp$'
+//	    action: drop
+//
+// Allow and deny lists are checked first. The rules are then applied in order, each to
+// the metric as it was left by the rules before it. Names and tag values in rename and
+// tag rules can refer to the match's capture groups, as $1 or ${name}. A RuleSink checks
+// renamed metrics with the NamePolicy, and drops (and reports) the ones it rejects.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	UnknownRuleAction = errors.New("Unknown rule action")
+	NoRulesSource     = errors.New("No rules found in the environment")
+	NoRenameName      = errors.New("Rename rules need a name")
+)
+
+// Actions for rules
+const (
+	RuleRename = "rename" // Rename the metric to Name
+	RuleTag    = "tag"    // Add (or replace) Tags
+	RuleUntag  = "untag"  // Remove the tags listed in Remove
+	RuleDrop   = "drop"   // Don't send the metric
+)
+
+// Rule is a single transformation. See the example at the top of rules.go.
+type Rule struct {
+	Match  string            `json:"match" yaml:"match"` // Regular expression for the metric name
+	Action string            `json:"action" yaml:"action"`
+	Name   string            `json:"name,omitempty" yaml:"name,omitempty"`
+	Tags   map[string]string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Remove []string          `json:"remove,omitempty" yaml:"remove,omitempty"`
+}
+
+// RuleConfig is the file (or environment) form of a set of rules.
+type RuleConfig struct {
+	Allow []string `json:"allow,omitempty" yaml:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty" yaml:"deny,omitempty"`
+	Rules []Rule   `json:"rules,omitempty" yaml:"rules,omitempty"`
+}
+
+// Rules are a compiled RuleConfig. Rules are immutable and safe for concurrent use.
+type Rules struct {
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+	rules []compiledRule
+}
+
+type compiledRule struct {
+	Rule
+	re *regexp.Regexp
+}
+
+// Compile the config into Rules, checking all of the expressions and actions.
+func (rc RuleConfig) Compile() (*Rules, error) {
+	r := &Rules{}
+	var err error
+	if r.allow, err = compileAll(rc.Allow); err != nil {
+		return nil, err
+	}
+	if r.deny, err = compileAll(rc.Deny); err != nil {
+		return nil, err
+	}
+	for i, rule := range rc.Rules {
+		switch rule.Action {
+		case RuleRename, RuleTag, RuleUntag, RuleDrop:
+		default:
+			return nil, fmt.Errorf("rule %d: %w: %q", i, UnknownRuleAction, rule.Action)
+		}
+		if rule.Action == RuleRename && rule.Name == "" {
+			return nil, fmt.Errorf("rule %d: %w", i, NoRenameName)
+		}
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		r.rules = append(r.rules, compiledRule{Rule: rule, re: re})
+	}
+	return r, nil
+}
+
+func compileAll(exprs []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(exprs))
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// ParseRules parses and compiles a rules document. YAML is a superset of JSON, so
+// either format can be passed here.
+func ParseRules(data []byte) (*Rules, error) {
+	var rc RuleConfig
+	if err := yaml.UnmarshalStrict(data, &rc); err != nil {
+		return nil, err
+	}
+	return rc.Compile()
+}
+
+// LoadRules reads rules from a file. Files ending in .json are parsed as JSON;
+// anything else is parsed as YAML.
+func LoadRules(path string) (*Rules, error) {
+	var rc RuleConfig
+	if err := loadConfig(path, &rc); err != nil {
+		return nil, err
+	}
+	return rc.Compile()
+}
+
+// loadConfig decodes a JSON or YAML file (by extension) into v. Either way, unknown
+// fields are an error, so that a misspelled key isn't silently ignored.
+func loadConfig(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		return dec.Decode(v)
+	}
+	return yaml.UnmarshalStrict(data, v)
+}
+
+// RulesFromEnv reads a rules document (JSON or YAML) from the named environment
+// variable. If the variable isn't set, NoRulesSource is returned.
+func RulesFromEnv(name string) (*Rules, error) {
+	doc, ok := os.LookupEnv(name)
+	if !ok || strings.TrimSpace(doc) == "" {
+		return nil, NoRulesSource
+	}
+	return ParseRules([]byte(doc))
+}
+
+// Apply the rules to a metric name and its tags. If the metric should be
+// dropped, ok is false.
+func (r *Rules) Apply(name string, tags Tags) (string, Tags, bool) {
+	if len(r.allow) > 0 && !matchesAny(r.allow, name) {
+		return "", nil, false
+	} else if matchesAny(r.deny, name) {
+		return "", nil, false
+	}
+	copied := false // tags are copied on the first change
+	for _, rule := range r.rules {
+		match := rule.re.FindStringSubmatchIndex(name)
+		if match == nil {
+			continue
+		}
+		switch rule.Action {
+		case RuleDrop:
+			return "", nil, false
+		case RuleRename:
+			name = string(rule.re.ExpandString(nil, rule.Name, name, match))
+		case RuleTag:
+			if !copied {
+				tags, copied = tags.With(nil), true
+			}
+			for k, v := range rule.Tags {
+				tags[k] = string(rule.re.ExpandString(nil, v, name, match))
+			}
+		case RuleUntag:
+			if !copied {
+				tags, copied = tags.With(nil), true
+			}
+			for _, k := range rule.Remove {
+				delete(tags, k)
+			}
+		}
+	}
+	return name, tags, true
+}
+
+func matchesAny(res []*regexp.Regexp, name string) bool {
+	for _, re := range res {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleSink applies Rules to every metric on its way to the wrapped Sink. The rules
+// can be replaced at any time, and Watch will do that whenever a rules file changes.
+type RuleSink struct {
+	transformSink
+	rules atomic.Pointer[Rules]
+}
+
+// ApplyRules wraps sink in a RuleSink. If rules is nil, metrics pass through unchanged
+// until rules are set.
+func ApplyRules(sink Sink, rules *Rules) *RuleSink {
+	rs := &RuleSink{}
+	rs.transformSink = *newTransformSink(sink, rs.transform)
+	rs.SetRules(rules)
+	return rs
+}
+
+// SetRules replaces the rules. In-flight writes finish with the old rules.
+func (rs *RuleSink) SetRules(rules *Rules) {
+	rs.rules.Store(rules)
+}
+
+// Rules returns the rules currently in effect.
+func (rs *RuleSink) Rules() *Rules {
+	return rs.rules.Load()
+}
+
+func (rs *RuleSink) transform(ctx context.Context, m Metric) []Metric {
+	rules := rs.rules.Load()
+	if rules == nil {
+		return []Metric{m}
+	}
+	name, tags, ok := rules.Apply(m.Name(), tagsOf(m))
+	if !ok {
+		return nil
+	} else if name != m.Name() {
+		checked, err := checkName(namePolicyFor(ctx), name)
+		if err != nil {
+			reportError(ctx, err, "Dropping metric %s, which the rules renamed to %q", m.Name(), name)
+			return nil
+		}
+		name = checked
+	}
+	return []Metric{withIdentity(m, name, tags)}
+}
+
+// Watch loads the rules from the file at path, and then polls the file every interval
+// in the background, reloading the rules whenever the file's modification time changes.
+// If the first load fails, its error is returned and the file isn't watched. If a later
+// load fails, the current rules stay in effect and the error is logged. Polling stops
+// when ctx is done.
+func (rs *RuleSink) Watch(ctx context.Context, path string, interval time.Duration) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	rules, err := LoadRules(path)
+	if err != nil {
+		return err
+	}
+	rs.SetRules(rules)
+	go rs.poll(ctx, path, fi.ModTime(), interval)
+	return nil
+}
+
+func (rs *RuleSink) poll(ctx context.Context, path string, lastMod time.Time, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fi, err := os.Stat(path)
+			if err != nil {
+				reportError(ctx, err, "Can't check metric rules file %s", path)
+				continue
+			} else if fi.ModTime().Equal(lastMod) {
+				continue
+			}
+			lastMod = fi.ModTime()
+			rules, err := LoadRules(path)
+			if err != nil {
+				reportError(ctx, err, "Error reloading metric rules from %s, keeping the current rules", path)
+				continue
+			}
+			rs.SetRules(rules)
+		}
+	}
+}
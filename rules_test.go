@@ -0,0 +1,148 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testRules = `
+allow: ['^api[./]']
+deny: ['^api[./]debug[./]']
+rules:
+  - match: '^api\.(\w+)\.(\w+)\.latency$'
+    action: rename
+    name: 'api.latency'
+  - match: '^api\.users\.(?P<method>\w+)$'
+    action: tag
+    tags: {method: '${method}', service: users}
+  - match: '^api\.users\.'
+    action: untag
+    remove: [host]
+  - match: '\.tmp$'
+    action: drop
+`
+
+var ruleChecks = []struct {
+	name     string
+	tags     Tags
+	expected string
+	tagStr   string
+	ok       bool
+}{
+	{"web.home", nil, "", "", false},
+	{"api.debug.dump", nil, "", "", false},
+	{"api.users.get.latency", nil, "api.latency", "", true},
+	{"api.users.get", Tags{"host": "h1"}, "api.users.get", "method=get,service=users", true},
+	{"api.users.get.tmp", nil, "", "", false},
+	{"api.other", Tags{"host": "h1"}, "api.other", "host=h1", true},
+}
+
+func TestRules(t *testing.T) {
+	rules, err := ParseRules([]byte(testRules))
+	if err != nil {
+		t.Fatalf("Error parsing rules: %s", err)
+	}
+	for _, test := range ruleChecks {
+		name, tags, ok := rules.Apply(test.name, test.tags)
+		if ok != test.ok || name != test.expected || tags.String() != test.tagStr {
+			t.Errorf("Applying rules to %s: expected (%s, %s, %t), got (%s, %s, %t)",
+				test.name, test.expected, test.tagStr, test.ok, name, tags, ok)
+		}
+	}
+	if test := ruleChecks[3]; test.tags.String() != "host=h1" {
+		t.Errorf("Rules should not modify the tags they are passed, got %s", test.tags)
+	}
+}
+
+func TestBadRules(t *testing.T) {
+	if _, err := ParseRules([]byte(`{"rules": [{"match": "x", "action": "explode"}]}`)); err == nil {
+		t.Errorf("Expected an error for an unknown action")
+	}
+	if _, err := ParseRules([]byte(`{"deny": ["(unclosed"]}`)); err == nil {
+		t.Errorf("Expected an error for a bad expression")
+	}
+	if _, err := ParseRules([]byte(`{"rules": [{"match": "x", "action": "rename"}]}`)); !errors.Is(err, NoRenameName) {
+		t.Errorf("Expected %s, got %v", NoRenameName, err)
+	}
+}
+
+func TestLoadRulesUnknownField(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"rules.json", "rules.yaml"} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(`{"deny": ["^secret"], "denny": ["^typo"]}`), 0644)
+		if _, err := LoadRules(path); err == nil {
+			t.Errorf("Expected an error for the misspelled key in %s", name)
+		}
+	}
+}
+
+func TestRuleSinkIllegalRename(t *testing.T) {
+	errs := make(chan error, 1)
+	SetErrorHandler(func(ctx context.Context, err error) { errs <- err })
+	defer SetErrorHandler(nil)
+	rules, err := ParseRules([]byte(`{"rules": [{"match": "^api\\.(\\w+)$", "action": "rename", "name": "$1 and more"}]}`))
+	if err != nil {
+		t.Fatalf("Error parsing rules: %s", err)
+	}
+	sink := &recordingSink{}
+	ApplyRules(sink, rules).WriteCounters(context.Background(), makeCounter("api.users"), makeCounter("web.home"))
+	if len(sink.counters) != 1 || sink.counters[0].Name() != "web.home" {
+		t.Errorf("Expected the illegally renamed metric to be dropped, got %v", sink.counters)
+	}
+	select {
+	case err := <-errs:
+		if !errors.Is(err, IllegalMetricName) {
+			t.Errorf("Expected %s, got %v", IllegalMetricName, err)
+		}
+	default:
+		t.Errorf("Expected the dropped metric to be reported")
+	}
+}
+
+func TestRulesFromEnv(t *testing.T) {
+	t.Setenv("STATS_TEST_RULES", `{"deny": ["^secret"]}`)
+	rules, err := RulesFromEnv("STATS_TEST_RULES")
+	if err != nil {
+		t.Fatalf("Error loading rules from env: %s", err)
+	}
+	if _, _, ok := rules.Apply("secret/counter", nil); ok {
+		t.Errorf("Expected secret/counter to be denied")
+	}
+	if _, err := RulesFromEnv("STATS_TEST_NO_SUCH_VAR"); err != NoRulesSource {
+		t.Errorf("Expected %s, got %v", NoRulesSource, err)
+	}
+}
+
+func TestRuleSinkWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	os.WriteFile(path, []byte(`{"deny": ["^first"]}`), 0644)
+	sink := &recordingSink{}
+	rs := ApplyRules(sink, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := rs.Watch(ctx, path, 5*time.Millisecond); err != nil {
+		t.Fatalf("Error loading rules: %s", err)
+	}
+	rules := rs.Rules()
+
+	rs.WriteCounters(ctx, makeCounter("first/counter"), makeCounter("second/counter"))
+	if len(sink.counters) != 1 || sink.counters[0].Name() != "second/counter" {
+		t.Errorf("Expected only second/counter to be written, got %v", sink.counters)
+	}
+	os.WriteFile(path, []byte(`{"deny": ["^second"]}`), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	deadline := time.Now().Add(time.Second)
+	for rs.Rules() == rules && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	sink.counters = nil
+	rs.WriteCounters(ctx, makeCounter("first/counter"), makeCounter("second/counter"))
+	if len(sink.counters) != 1 || sink.counters[0].Name() != "first/counter" {
+		t.Errorf("Expected reloaded rules to let only first/counter through, got %v", sink.counters)
+	}
+}
@@ -0,0 +1,203 @@
+package stats
+
+// Sampling records only a fraction of the events for busy metrics, like the |@0.1 of
+// StatsD. The rate for an event comes from, in order of precedence:
+//
+//  1. the call itself (IncrementSampled, StartTimerSampled)
+//  2. the bucket's rate, set with SetSampleRate
+//  3. adaptive sampling, if it's on (see SetAdaptiveSampling)
+//
+// and is otherwise 1. Sampled metrics carry their rate (see SampleRate), so sinks can
+// scale values back up or pass the rate on to a backend that does. Counter.Estimate
+// does the scaling for counters. The Aggregator and the Stackdriver sink write
+// estimates.
+//
+// Adaptive sampling keeps a window of counts per bucket. Windows that haven't seen an
+// event in rateWindowIdle are evicted, and past maxRateWindows buckets, new buckets
+// aren't sampled adaptively until there's room again, so that dynamic bucket names
+// can't grow the windows without bound.
+//
+// A counter can be incremented at different rates within a request. Its SampleRate is
+// then the effective rate over all of its increments, so that Estimate is still exact.
+// Gauges and histograms aren't sampled.
+
+import (
+	"math"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type samplingConfig struct {
+	rates    map[string]float64 // bucket -> fixed rate
+	adaptive float64            // target events per second per bucket; 0 is off
+}
+
+var (
+	samplingMu  sync.Mutex // serializes changes to the config
+	sampling    atomic.Pointer[samplingConfig]
+	rateWindows sync.Map // bucket -> *rateWindow, for adaptive sampling
+
+	rateWindowCount atomic.Int64
+	rateWindowSweep sync.Mutex
+	lastSweep       atomic.Int64 // unix nanos
+)
+
+// Limits on the adaptive sampling windows; see the top of sampling.go
+var maxRateWindows int64 = 10000
+
+const rateWindowIdle = time.Minute
+
+func init() {
+	sampling.Store(&samplingConfig{rates: make(map[string]float64)})
+}
+
+// SetSampleRate sets the rate at which events for the bucket are recorded. A rate of
+// 1 or more (or 0 or less) removes the bucket's rate. It takes effect for buckets as
+// they're first used in a request.
+func SetSampleRate(bucket string, rate float64) {
+	samplingMu.Lock()
+	defer samplingMu.Unlock()
+	current := sampling.Load()
+	next := &samplingConfig{rates: make(map[string]float64, len(current.rates)+1), adaptive: current.adaptive}
+	for k, v := range current.rates {
+		next.rates[k] = v
+	}
+	if rate <= 0 || rate >= 1 {
+		delete(next.rates, bucket)
+	} else {
+		next.rates[bucket] = rate
+	}
+	sampling.Store(next)
+}
+
+// SetAdaptiveSampling turns on adaptive sampling for buckets without a rate of their
+// own: each bucket's rate is adjusted every second so that about maxPerSecond of its
+// events are recorded per second, across the process. Zero turns adaptive sampling off.
+func SetAdaptiveSampling(maxPerSecond float64) {
+	samplingMu.Lock()
+	defer samplingMu.Unlock()
+	current := sampling.Load()
+	sampling.Store(&samplingConfig{rates: current.rates, adaptive: maxPerSecond})
+}
+
+// sampler decides the rate for a bucket's events. The zero sampler's rate is always 1.
+type sampler struct {
+	fixed  float64
+	window *rateWindow
+	target float64
+}
+
+// samplerFor looks up the sampling config for a bucket, when the bucket is first used in a request
+func samplerFor(bucket string) sampler {
+	cfg := sampling.Load()
+	if rate, ok := cfg.rates[bucket]; ok {
+		return sampler{fixed: rate}
+	} else if cfg.adaptive <= 0 {
+		return sampler{}
+	}
+	w, ok := rateWindows.Load(bucket)
+	if !ok {
+		if !reserveRateWindow() {
+			return sampler{}
+		}
+		var loaded bool
+		if w, loaded = rateWindows.LoadOrStore(bucket, newRateWindow()); loaded {
+			rateWindowCount.Add(-1)
+		}
+	}
+	return sampler{window: w.(*rateWindow), target: cfg.adaptive}
+}
+
+// reserveRateWindow makes room for a new window, evicting idle ones if there are
+// too many. It's false if there's no room.
+func reserveRateWindow() bool {
+	if rateWindowCount.Add(1) <= maxRateWindows {
+		return true
+	}
+	rateWindowCount.Add(-1)
+	evictIdleRateWindows()
+	if rateWindowCount.Add(1) <= maxRateWindows {
+		return true
+	}
+	rateWindowCount.Add(-1)
+	return false
+}
+
+// evictIdleRateWindows removes the windows that haven't seen an event for a while.
+// It only looks once a second, since it has to go through all of them.
+func evictIdleRateWindows() {
+	now := time.Now().UnixNano()
+	if now-lastSweep.Load() < int64(time.Second) || !rateWindowSweep.TryLock() {
+		return
+	}
+	defer rateWindowSweep.Unlock()
+	lastSweep.Store(now)
+	cutoff := now - int64(rateWindowIdle)
+	rateWindows.Range(func(bucket, w any) bool {
+		if w.(*rateWindow).lastEvent.Load() < cutoff && rateWindows.CompareAndDelete(bucket, w) {
+			rateWindowCount.Add(-1)
+		}
+		return true
+	})
+}
+
+// rate for the next event
+func (s sampler) rate() float64 {
+	switch {
+	case s.window != nil:
+		return s.window.observe(s.target)
+	case s.fixed > 0:
+		return s.fixed
+	}
+	return 1
+}
+
+// sampled decides whether an event at rate is recorded
+func sampled(rate float64) bool {
+	return rate >= 1 || rand.Float64() < rate
+}
+
+// rateWindow counts a bucket's events in one-second windows, and sets the rate for
+// each window from the count in the one before
+type rateWindow struct {
+	start     atomic.Int64 // unix nanos
+	count     atomic.Int64
+	rate      atomic.Uint64 // math.Float64bits
+	lastEvent atomic.Int64  // unix nanos
+}
+
+func newRateWindow() *rateWindow {
+	w := &rateWindow{}
+	now := time.Now().UnixNano()
+	w.start.Store(now)
+	w.lastEvent.Store(now)
+	w.rate.Store(math.Float64bits(1))
+	return w
+}
+
+func (w *rateWindow) observe(target float64) float64 {
+	now := time.Now().UnixNano()
+	w.lastEvent.Store(now)
+	start := w.start.Load()
+	if elapsed := now - start; elapsed >= int64(time.Second) && w.start.CompareAndSwap(start, now) {
+		perSecond := float64(w.count.Swap(0)) / (float64(elapsed) / float64(time.Second))
+		rate := 1.0
+		if perSecond > target {
+			rate = target / perSecond
+		}
+		w.rate.Store(math.Float64bits(rate))
+	}
+	w.count.Add(1)
+	return math.Float64frombits(w.rate.Load())
+}
+
+// rateOf returns the sample rate of any of the metric types in this package, or 0 if it
+// wasn't sampled
+func rateOf(m Metric) float64 {
+	if r, ok := m.(interface{ SampleRate() float64 }); ok && r.SampleRate() < 1 {
+		return r.SampleRate()
+	}
+	return 0
+}
@@ -0,0 +1,120 @@
+package stats
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCounterEstimate(t *testing.T) {
+	c := makeCounter("test/counter")
+	c.incrementSampled(1)
+	c.incrementSampled(0.5)
+	c.incrementSampled(0.25)
+	if c.Data() != 3 || c.Estimate() != 7 {
+		t.Errorf("Expected 3 recorded and an estimate of 7, got %d and %d", c.Data(), c.Estimate())
+	}
+	other := makeCounter("test/counter")
+	other.incrementSampled(0.1)
+	merged := c.merge(other)
+	if merged.Data() != 4 || merged.Estimate() != 17 || c.Data() != 3 {
+		t.Errorf("Expected a merged estimate of 17 from 4, got %d from %d", merged.Estimate(), merged.Data())
+	}
+	if unsampled := testCounter("test/counter", 5); unsampled.SampleRate() != 1 || unsampled.Estimate() != 5 {
+		t.Errorf("Unsampled counters should be as recorded")
+	}
+}
+
+func TestSampledRecording(t *testing.T) {
+	ctx := requestContextUsingMetrics()
+	rs, _ := statsFromContext(ctx)
+	for i := 0; i < 100; i++ {
+		IncrementSampled(ctx, "test/never", 1e-12)
+		IncrementSampled(ctx, "test/always", 1)
+	}
+	if rs.counters["test/never"].Data() != 0 || rs.counters["test/always"].Data() != 100 {
+		t.Errorf("Expected no increments at a tiny rate and all of them at 1")
+	}
+
+	SetSampleRate("test/half", 0.5)
+	defer SetSampleRate("test/half", 1)
+	for i := 0; i < 1000; i++ {
+		Increment(ctx, "test/half")
+	}
+	half := rs.counters["test/half"]
+	if half.SampleRate() != 0.5 || half.Data() < 350 || half.Data() > 650 {
+		t.Errorf("Expected about 500 increments at 0.5, got %d at %f", half.Data(), half.SampleRate())
+	}
+
+	if err := StartTimerSampled(ctx, "test/timer", 1e-12); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := FinishTimer(ctx, "test/timer"); err != nil {
+		t.Errorf("Sampled-out timers should still finish, got %s", err)
+	}
+	if _, ok := rs.timers["test/timer"]; ok {
+		t.Errorf("Sampled-out timer wasn't discarded")
+	}
+}
+
+func TestAdaptiveSampling(t *testing.T) {
+	w := newRateWindow()
+	for i := 0; i < 1000; i++ {
+		w.observe(100)
+	}
+	if rate := w.observe(100); rate != 1 {
+		t.Errorf("Rate shouldn't change within the first window, got %f", rate)
+	}
+	w.start.Store(time.Now().Add(-time.Second).UnixNano())
+	if rate := w.observe(100); math.Abs(rate-0.1) > 0.01 {
+		t.Errorf("Expected a rate of about 0.1 after 1000 events in a second, got %f", rate)
+	}
+
+	SetAdaptiveSampling(10)
+	defer SetAdaptiveSampling(0)
+	if s := samplerFor("test/adaptive"); s.window == nil || s.target != 10 {
+		t.Errorf("Expected an adaptive sampler, got %+v", s)
+	}
+	SetSampleRate("test/fixed", 0.2)
+	defer SetSampleRate("test/fixed", 0)
+	if s := samplerFor("test/fixed"); s.window != nil || s.rate() != 0.2 {
+		t.Errorf("Fixed rates should take precedence over adaptive sampling, got %+v", s)
+	}
+}
+
+// clearRateWindows forgets the adaptive sampling windows
+func clearRateWindows() {
+	rateWindows.Range(func(bucket, w any) bool {
+		if rateWindows.CompareAndDelete(bucket, w) {
+			rateWindowCount.Add(-1)
+		}
+		return true
+	})
+}
+
+func TestRateWindowLimit(t *testing.T) {
+	SetAdaptiveSampling(10)
+	defer SetAdaptiveSampling(0)
+	defer func(max int64) { maxRateWindows = max }(maxRateWindows)
+	clearRateWindows()
+	defer clearRateWindows()
+	maxRateWindows = 2
+
+	samplerFor("test/window/a")
+	if s := samplerFor("test/window/b"); s.window == nil {
+		t.Fatalf("Expected an adaptive sampler while there's room")
+	}
+	if s := samplerFor("test/window/c"); s.window != nil || s.rate() != 1 {
+		t.Errorf("Expected no adaptive sampling once the windows are full, got %+v", s)
+	}
+	// once a window has been idle for long enough, it makes room
+	w, _ := rateWindows.Load("test/window/a")
+	w.(*rateWindow).lastEvent.Store(time.Now().Add(-2 * rateWindowIdle).UnixNano())
+	lastSweep.Store(0)
+	if s := samplerFor("test/window/c"); s.window == nil {
+		t.Errorf("Expected the idle window to be evicted to make room")
+	}
+	if _, ok := rateWindows.Load("test/window/a"); ok {
+		t.Errorf("Expected the idle window to be gone")
+	}
+}
@@ -0,0 +1,258 @@
+package stats
+
+// The stats package keeps metrics about itself, so that you can tell whether it's
+// dropping data or slowing things down:
+//
+//	stats/events/queued       counter    metrics handed to the sink goroutine
+//	stats/events/delivered    counter    metrics the sink accepted
+//	stats/events/dropped      counter    metrics the sink returned errors for
+//	stats/sink/errors         counter    sink errors, tagged with their type (see SinkErrorType)
+//	stats/sink/latency        histogram  time taken by each write to the sink
+//	stats/names/rejected      counter    bucket names rejected by the NamePolicy
+//	stats/timers/unfinished   counter    timers that were still running when a request finished
+//
+// They're totals for the process, and they're available in two ways. ReportSelfMetrics
+// writes them to a sink periodically (generally the same sink as the requests' metrics):
+//
+//	go stats.ReportSelfMetrics(ctx, sink, time.Minute)
+//
+// and SelfMetricsHandler serves the running totals as JSON:
+//
+//	http.Handle("/debug/stats", stats.SelfMetricsHandler())
+//
+// Names starting with SelfPrefix are reserved for these metrics (and for the state of
+// BreakerSinks). Recording a bucket with one of them returns ReservedMetricName.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SelfPrefix starts the names of the metrics the stats package reports about itself.
+const SelfPrefix = "stats/"
+
+var ReservedMetricName = errors.New("Metric names starting with " + SelfPrefix + " are reserved")
+
+// Names of the self metrics
+const (
+	SelfQueued           = SelfPrefix + "events/queued"
+	SelfDelivered        = SelfPrefix + "events/delivered"
+	SelfDropped          = SelfPrefix + "events/dropped"
+	SelfSinkErrors       = SelfPrefix + "sink/errors"
+	SelfSinkLatency      = SelfPrefix + "sink/latency"
+	SelfRejectedNames    = SelfPrefix + "names/rejected"
+	SelfUnfinishedTimers = SelfPrefix + "timers/unfinished"
+)
+
+// Sink write latencies are kept as a sample of at most this many between reports
+const maxLatencySamples = 1024
+
+// SelfMetrics are the running totals of the stats package's own metrics.
+type SelfMetrics struct {
+	Queued           int64            `json:"queued"`
+	Delivered        int64            `json:"delivered"`
+	Dropped          int64            `json:"dropped"`
+	SinkErrors       map[string]int64 `json:"sink_errors"` // by SinkErrorType
+	SinkWrites       int64            `json:"sink_writes"`
+	SinkLatency      time.Duration    `json:"sink_latency_ns"` // total
+	MaxSinkLatency   time.Duration    `json:"max_sink_latency_ns"`
+	RejectedNames    int64            `json:"rejected_names"`
+	UnfinishedTimers int64            `json:"unfinished_timers"`
+}
+
+var self struct {
+	queued, delivered, dropped atomic.Int64
+	rejectedNames              atomic.Int64
+	unfinishedTimers           atomic.Int64
+	sinkErrors                 sync.Map // type -> *atomic.Int64
+
+	mu         sync.Mutex // guards the latencies
+	writes     int64
+	latency    time.Duration
+	maxLatency time.Duration
+	samples    []time.Duration // since the last report
+	seen       int             // latencies since the last report, for sampling
+}
+
+// CurrentSelfMetrics returns the stats package's own metrics, as of now.
+func CurrentSelfMetrics() SelfMetrics {
+	m := SelfMetrics{
+		Queued:           self.queued.Load(),
+		Delivered:        self.delivered.Load(),
+		Dropped:          self.dropped.Load(),
+		SinkErrors:       make(map[string]int64),
+		RejectedNames:    self.rejectedNames.Load(),
+		UnfinishedTimers: self.unfinishedTimers.Load(),
+	}
+	self.sinkErrors.Range(func(k, v interface{}) bool {
+		m.SinkErrors[k.(string)] = v.(*atomic.Int64).Load()
+		return true
+	})
+	self.mu.Lock()
+	m.SinkWrites, m.SinkLatency, m.MaxSinkLatency = self.writes, self.latency, self.maxLatency
+	self.mu.Unlock()
+	return m
+}
+
+// SelfMetricsHandler serves CurrentSelfMetrics as JSON.
+func SelfMetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(CurrentSelfMetrics())
+	})
+}
+
+// ReportSelfMetrics writes the stats package's own metrics to sink every interval,
+// until ctx is done. Counters are written as the change since the last report, and
+// the latency histogram as a sample of the writes since the last report, so there
+// should only be one of these running in a process.
+func ReportSelfMetrics(ctx context.Context, sink Sink, interval time.Duration) {
+	sink = withNameTranslation(sink)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := SelfMetrics{SinkErrors: make(map[string]int64)}
+	for {
+		select {
+		case <-ticker.C:
+			current := CurrentSelfMetrics()
+			if err := WriteBatch(ctx, sink, selfBatch(last, current, drainLatencySamples())); err != nil {
+				reportError(ctx, err, "Error reporting the stats package's own metrics")
+			}
+			last = current
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// selfBatch makes the metrics for a report covering from last to current
+func selfBatch(last, current SelfMetrics, latencies []time.Duration) Batch {
+	var batch Batch
+	counter := func(name string, delta int64, tags Tags) {
+		if delta > 0 {
+			c := makeCounter(name)
+			c.data = int(delta)
+			c.tags = tags
+			batch = append(batch, c)
+		}
+	}
+	counter(SelfQueued, current.Queued-last.Queued, nil)
+	counter(SelfDelivered, current.Delivered-last.Delivered, nil)
+	counter(SelfDropped, current.Dropped-last.Dropped, nil)
+	counter(SelfRejectedNames, current.RejectedNames-last.RejectedNames, nil)
+	counter(SelfUnfinishedTimers, current.UnfinishedTimers-last.UnfinishedTimers, nil)
+	for kind, n := range current.SinkErrors {
+		counter(SelfSinkErrors, n-last.SinkErrors[kind], Tags{"type": kind})
+	}
+	if len(latencies) > 0 {
+		h := makeHistogram(SelfSinkLatency)
+		for _, d := range latencies {
+			h.Observe(d)
+		}
+		batch = append(batch, h)
+	}
+	return batch
+}
+
+// isReservedName is true for names that only the stats package can use
+func isReservedName(name string) bool {
+	return strings.HasPrefix(name, SelfPrefix)
+}
+
+// countMetrics is the number of metrics carried by a channel event
+func countMetrics(event Metric) int64 {
+	if b, ok := event.(*batchEvent); ok {
+		return int64(len(b.batch))
+	}
+	return 1
+}
+
+// recordWrite counts the outcome of a write of n metrics to a sink, which took d
+func recordWrite(n int64, d time.Duration, err error) {
+	self.mu.Lock()
+	self.writes++
+	self.latency += d
+	if d > self.maxLatency {
+		self.maxLatency = d
+	}
+	// keep a uniform sample of the latencies (reservoir sampling)
+	self.seen++
+	if len(self.samples) < maxLatencySamples {
+		self.samples = append(self.samples, d)
+	} else if i := rand.IntN(self.seen); i < maxLatencySamples {
+		self.samples[i] = d
+	}
+	self.mu.Unlock()
+
+	if err == nil {
+		self.delivered.Add(n)
+		return
+	}
+	errs := flatten(err)
+	failed := int64(0)
+	for _, e := range errs {
+		var me *MetricError
+		if errors.As(e, &me) {
+			failed++
+		}
+		countSinkError(SinkErrorType(e))
+	}
+	if failed == 0 || failed > n {
+		failed = n // the write failed as a whole
+	}
+	self.dropped.Add(failed)
+	self.delivered.Add(n - failed)
+}
+
+func countSinkError(kind string) {
+	v, ok := self.sinkErrors.Load(kind)
+	if !ok {
+		v, _ = self.sinkErrors.LoadOrStore(kind, new(atomic.Int64))
+	}
+	v.(*atomic.Int64).Add(1)
+}
+
+func drainLatencySamples() []time.Duration {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	samples := self.samples
+	self.samples = nil
+	self.seen = 0
+	return samples
+}
+
+// SinkErrorType classifies a sink error for the stats/sink/errors metric: one of
+// "circuit_open", "queue_full", "spill_full", "retry_limit", "timeout", "canceled",
+// "retryable", "permanent" (errors marked as not retryable) or "other".
+func SinkErrorType(err error) string {
+	var r Retryable
+	switch {
+	case errors.Is(err, CircuitOpen):
+		return "circuit_open"
+	case errors.Is(err, QueueFull):
+		return "queue_full"
+	case errors.Is(err, SpillFull):
+		return "spill_full"
+	case errors.Is(err, RetryLimitExceeded):
+		return "retry_limit"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &r):
+		if r.Retryable() {
+			return "retryable"
+		}
+		return "permanent"
+	case IsRetryable(err):
+		return "retryable"
+	}
+	return "other"
+}
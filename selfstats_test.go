@@ -0,0 +1,114 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/efixler/multierror"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReservedNames(t *testing.T) {
+	ctx := requestContextUsingMetrics()
+	before := CurrentSelfMetrics()
+	if err := Increment(ctx, "stats/events/queued"); err != ReservedMetricName {
+		t.Errorf("Expected ReservedMetricName, got %v", err)
+	}
+	if err := Increment(ctx, "bad..name"); err != IllegalMetricName {
+		t.Errorf("Expected IllegalMetricName, got %v", err)
+	}
+	if n := CurrentSelfMetrics().RejectedNames - before.RejectedNames; n != 2 {
+		t.Errorf("Expected 2 rejected names, got %d", n)
+	}
+}
+
+func TestSelfMetricsFromPipeline(t *testing.T) {
+	before := CurrentSelfMetrics()
+	handler := Metrics(failingSink{}, WithErrorHandler(func(context.Context, error) {}))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Increment(r.Context(), "test/counter")
+			StartTimer(r.Context(), "test/unfinished")
+		}))
+	ctx, cancel := context.WithCancel(context.Background())
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	cancel()
+
+	waitFor(t, func() bool { return CurrentSelfMetrics().Dropped-before.Dropped == 2 })
+	after := CurrentSelfMetrics()
+	if after.Queued-before.Queued != 2 || after.UnfinishedTimers-before.UnfinishedTimers != 1 {
+		t.Errorf("Expected 2 queued and 1 unfinished timer, got %+v", after)
+	}
+	if after.SinkErrors["other"]-before.SinkErrors["other"] != 1 || after.SinkWrites == before.SinkWrites {
+		t.Errorf("Expected the failed write to be counted, got %+v", after)
+	}
+}
+
+func TestRecordPartialFailure(t *testing.T) {
+	before := CurrentSelfMetrics()
+	err := multierror.MultiError{&MetricError{Metric: testCounter("test/counter", 1), Err: MarkRetryable(errors.New("busy"), true)}}
+	recordWrite(3, time.Millisecond, err)
+	after := CurrentSelfMetrics()
+	if after.Delivered-before.Delivered != 2 || after.Dropped-before.Dropped != 1 {
+		t.Errorf("Expected 2 delivered and 1 dropped, got %+v", after)
+	}
+	if after.SinkErrors["retryable"]-before.SinkErrors["retryable"] != 1 {
+		t.Errorf("Expected a retryable error, got %v", after.SinkErrors)
+	}
+}
+
+func TestSinkErrorType(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind string
+	}{
+		{CircuitOpen, "circuit_open"},
+		{&PipelineError{Message: "Error", Err: QueueFull}, "queue_full"},
+		{context.DeadlineExceeded, "timeout"},
+		{MarkRetryable(errors.New("bad request"), false), "permanent"},
+		{MarkRetryable(errors.New("unavailable"), true), "retryable"},
+		{errors.New("failed"), "other"},
+	}
+	for _, test := range tests {
+		if kind := SinkErrorType(test.err); kind != test.kind {
+			t.Errorf("Expected %s for %v, got %s", test.kind, test.err, kind)
+		}
+	}
+}
+
+func TestSelfBatch(t *testing.T) {
+	last := SelfMetrics{Queued: 5, SinkErrors: map[string]int64{"other": 1}}
+	current := SelfMetrics{Queued: 8, Delivered: 3, SinkErrors: map[string]int64{"other": 1, "timeout": 2}}
+	batch := selfBatch(last, current, []time.Duration{time.Millisecond})
+	got := make(map[string]int)
+	for _, m := range batch {
+		got[m.Name()+tagsOf(m).String()] = m.Data()
+	}
+	want := map[string]int{
+		SelfQueued + Tags(nil).String():                   3,
+		SelfDelivered + Tags(nil).String():                3,
+		SelfSinkErrors + Tags{"type": "timeout"}.String(): 2,
+		SelfSinkLatency + Tags(nil).String():              1,
+	}
+	if len(got) != len(want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("Expected %s to be %d, got %d", k, v, got[k])
+		}
+	}
+}
+
+func TestSelfMetricsHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	SelfMetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/stats", nil))
+	var m SelfMetrics
+	if err := json.NewDecoder(w.Body).Decode(&m); err != nil {
+		t.Fatalf("Can't decode self metrics: %s", err)
+	} else if w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Wrong content type %s", w.Header().Get("Content-Type"))
+	}
+}
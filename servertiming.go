@@ -0,0 +1,148 @@
+package stats
+
+// ServerTiming reports a request's timers to the client in a Server-Timing header,
+// where browser devtools show them alongside the request:
+//
+//	router.Use(stats.Metrics(sink))
+//	router.Use(stats.ServerTiming(stats.ServerTimingPolicy{Header: "X-Debug-Timing", Trailer: true}))
+//
+// Only timers that have finished when the headers are sent can go in the header. With
+// Trailer set, timers that finish after that (e.g. while the body is being streamed)
+// are sent in a Server-Timing trailer, along with the total time spent in the handler.
+// Trailers need a response without a Content-Length, and not every client shows them.
+//
+// Server-Timing metric names have to be HTTP tokens, so characters that can't appear in
+// a token (like the slashes in bucket names) are replaced with underscores, and the
+// bucket is given as the metric's description.
+
+import (
+	"math"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const serverTimingHeader = "Server-Timing"
+
+// ServerTimingPolicy decides which requests get a Server-Timing header. A request gets
+// one if any of the conditions are met.
+type ServerTimingPolicy struct {
+	Always         bool                     // Every request
+	Header         string                   // A request header that, when present, turns it on
+	AllowedClients []netip.Prefix           // Clients whose address is in one of these
+	Allow          func(*http.Request) bool // Any other test
+	Trailer        bool                     // Send timers that finish late in a trailer
+}
+
+func (p ServerTimingPolicy) enabled(r *http.Request) bool {
+	switch {
+	case p.Always:
+		return true
+	case p.Header != "" && r.Header.Get(p.Header) != "":
+		return true
+	case p.Allow != nil && p.Allow(r):
+		return true
+	}
+	return allowedClient(p.AllowedClients, r)
+}
+
+// allowedClient is true if the request's remote address is in one of the prefixes
+func allowedClient(prefixes []netip.Prefix, r *http.Request) bool {
+	if len(prefixes) == 0 {
+		return false
+	}
+	addr, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr.Addr().Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServerTiming is middleware that adds the request's timers to the response as a
+// Server-Timing header. It has to come after Metrics.
+func ServerTiming(policy ServerTimingPolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !policy.enabled(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			start := time.Now()
+			ctx := r.Context()
+			rw := wrapResponse(w)
+			sent := make(map[string]time.Duration)
+			rw.onHeader(func(h http.Header) {
+				s, err := Snapshot(ctx)
+				if err != nil {
+					return
+				}
+				sent = s.Timers()
+				if v := serverTiming(sent); v != "" {
+					h.Add(serverTimingHeader, v)
+				}
+			})
+			next.ServeHTTP(rw, r)
+			rw.finish()
+			if !policy.Trailer {
+				return
+			}
+			s, err := Snapshot(ctx)
+			if err != nil {
+				return
+			}
+			late := s.Timers()
+			for bucket := range sent {
+				delete(late, bucket)
+			}
+			v := serverTiming(late)
+			total := serverTimingEntry("total", "", time.Since(start))
+			if v == "" {
+				v = total
+			} else {
+				v += ", " + total
+			}
+			rw.Header().Set(http.TrailerPrefix+serverTimingHeader, v)
+		})
+	}
+}
+
+// serverTiming formats timers as the value of a Server-Timing header, sorted by bucket
+func serverTiming(timers map[string]time.Duration) string {
+	buckets := make([]string, 0, len(timers))
+	for bucket := range timers {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	entries := make([]string, len(buckets))
+	for i, bucket := range buckets {
+		entries[i] = serverTimingEntry(httpToken(bucket), bucket, timers[bucket])
+	}
+	return strings.Join(entries, ", ")
+}
+
+func serverTimingEntry(name, desc string, d time.Duration) string {
+	ms := math.Round(float64(d)/float64(time.Microsecond)) / 1000
+	entry := name
+	if desc != "" && desc != name {
+		entry += ";desc=" + strconv.Quote(desc)
+	}
+	return entry + ";dur=" + strconv.FormatFloat(ms, 'f', -1, 64)
+}
+
+// httpToken replaces the characters in s that can't be in an HTTP token
+func httpToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		if isWordChar(r) || strings.ContainsRune("!#$%&'*+-.^`|~", r) {
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,118 @@
+package stats
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// chain puts the middleware together, with the first one outermost
+func chain(mws ...func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		for i := len(mws) - 1; i >= 0; i-- {
+			h = mws[i](h)
+		}
+		return h
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	mw := chain(Metrics(nil), ServerTiming(ServerTimingPolicy{Header: "X-Timing", Trailer: true}))
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		StartTimer(r.Context(), "db/query")
+		FinishTimer(r.Context(), "db/query")
+		StartTimer(r.Context(), "render")
+		w.Write([]byte("hello"))
+		FinishTimer(r.Context(), "render")
+	}
+
+	w := serve(mw, handler)
+	if v := w.Header().Get("Server-Timing"); v != "" {
+		t.Errorf("Server-Timing should be off without the request header, got %s", v)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Timing", "1")
+	res := serveRequest(mw, r, handler).Result()
+	header := res.Header.Get("Server-Timing")
+	if !strings.HasPrefix(header, `db_query;desc="db/query";dur=`) || strings.Contains(header, "render") {
+		t.Errorf("Expected only the finished timer in the header, got %s", header)
+	}
+	trailer := res.Trailer.Get("Server-Timing")
+	if !strings.HasPrefix(trailer, "render;dur=") || !strings.Contains(trailer, ", total;dur=") {
+		t.Errorf("Expected the late timer and the total in the trailer, got %s", trailer)
+	}
+}
+
+func TestServerTimingPolicy(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil) // from 192.0.2.1
+	tests := []struct {
+		policy  ServerTimingPolicy
+		enabled bool
+	}{
+		{ServerTimingPolicy{}, false},
+		{ServerTimingPolicy{Always: true}, true},
+		{ServerTimingPolicy{AllowedClients: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}}, true},
+		{ServerTimingPolicy{AllowedClients: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}, false},
+		{ServerTimingPolicy{Allow: func(r *http.Request) bool { return r.URL.Path == "/" }}, true},
+	}
+	for i, test := range tests {
+		if enabled := test.policy.enabled(r); enabled != test.enabled {
+			t.Errorf("Test %d: expected enabled to be %t", i, test.enabled)
+		}
+	}
+}
+
+func TestServerTimingFormat(t *testing.T) {
+	if v := serverTimingEntry("cache", "", 1500*1000); v != "cache;dur=1.5" {
+		t.Errorf("Unexpected entry %s", v)
+	}
+	if v := httpToken("db/query:users"); v != "db_query_users" {
+		t.Errorf("Unexpected token %s", v)
+	}
+}
+
+func TestOnHeaderAfterHeaders(t *testing.T) {
+	rw := wrapResponse(httptest.NewRecorder())
+	rw.onHeader(func(h http.Header) { h.Set("X-Before", "1") })
+	rw.Write([]byte("hello"))
+	rw.onHeader(func(h http.Header) { t.Error("Header hook added after the headers were sent was kept") })
+	if len(rw.beforeHeader) != 1 || rw.Header().Get("X-Before") != "1" {
+		t.Errorf("Expected just the first hook to run, got %d hooks", len(rw.beforeHeader))
+	}
+}
+
+// statusRecorder records every status written, which httptest.ResponseRecorder doesn't
+type statusRecorder struct {
+	*httptest.ResponseRecorder
+	statuses []int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.statuses = append(sr.statuses, status)
+}
+
+func TestInformationalHeaders(t *testing.T) {
+	w := &statusRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rw := wrapResponse(w)
+	var hooks int
+	rw.onHeader(func(h http.Header) { hooks++ })
+	rw.WriteHeader(http.StatusEarlyHints)
+	if rw.wroteHeader || hooks != 0 {
+		t.Errorf("A 103 shouldn't count as the response's headers, hooks ran %d times", hooks)
+	}
+	rw.WriteHeader(http.StatusNotFound)
+	if rw.Status() != http.StatusNotFound || hooks != 1 {
+		t.Errorf("Expected the final status to be 404 after running the hooks once, got %d, %d hooks", rw.Status(), hooks)
+	} else if len(w.statuses) != 2 || w.statuses[0] != http.StatusEarlyHints || w.statuses[1] != http.StatusNotFound {
+		t.Errorf("Expected both statuses to be written, got %v", w.statuses)
+	}
+
+	rw = wrapResponse(httptest.NewRecorder())
+	rw.WriteHeader(http.StatusSwitchingProtocols)
+	if !rw.wroteHeader || rw.Status() != http.StatusSwitchingProtocols {
+		t.Errorf("A 101 is the final response, got status %d", rw.Status())
+	}
+}
@@ -15,3 +15,129 @@ type Sink interface {
 	WriteCounters(ctx context.Context, counters ...*Counter) error
 	WriteTimers(ctx context.Context, timers ...*Timer) error
 }
+
+// transformSink passes each metric through a function on its way to the wrapped Sink.
+// The function returns the metrics to write in the original's place: the metric itself,
+// a modified copy (see withIdentity), several metrics, or nothing, to drop it.
+// A transform can't change the kind of a metric.
+type transformSink struct {
+	Sink
+	transform func(ctx context.Context, m Metric) []Metric
+}
+
+// newTransformSink wraps sink with the transform. A transformSink hides the wrapped
+// sink's own name translation, so it's applied here, to what the transform writes.
+func newTransformSink(sink Sink, transform func(ctx context.Context, m Metric) []Metric) *transformSink {
+	return &transformSink{Sink: withNameTranslation(sink), transform: transform}
+}
+
+func (ts *transformSink) WriteCounters(ctx context.Context, counters ...*Counter) error {
+	out := make([]*Counter, 0, len(counters))
+	for _, c := range counters {
+		for _, m := range ts.transform(ctx, c) {
+			if tc, ok := m.(*Counter); ok {
+				out = append(out, tc)
+			}
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return ts.Sink.WriteCounters(ctx, out...)
+}
+
+func (ts *transformSink) WriteTimers(ctx context.Context, timers ...*Timer) error {
+	out := make([]*Timer, 0, len(timers))
+	for _, t := range timers {
+		for _, m := range ts.transform(ctx, t) {
+			if tt, ok := m.(*Timer); ok {
+				out = append(out, tt)
+			}
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return ts.Sink.WriteTimers(ctx, out...)
+}
+
+// The optional capabilities are all passed through to the wrapped Sink, with the
+// transform applied on the way; see capabilities.go.
+
+func (ts *transformSink) WriteGauges(ctx context.Context, gauges ...*Gauge) error {
+	out := make([]*Gauge, 0, len(gauges))
+	for _, g := range gauges {
+		for _, m := range ts.transform(ctx, g) {
+			if tg, ok := m.(*Gauge); ok {
+				out = append(out, tg)
+			}
+		}
+	}
+	return WriteGauges(ctx, ts.Sink, out...)
+}
+
+func (ts *transformSink) WriteHistograms(ctx context.Context, histograms ...*Histogram) error {
+	out := make([]*Histogram, 0, len(histograms))
+	for _, h := range histograms {
+		for _, m := range ts.transform(ctx, h) {
+			if th, ok := m.(*Histogram); ok {
+				out = append(out, th)
+			}
+		}
+	}
+	return WriteHistograms(ctx, ts.Sink, out...)
+}
+
+func (ts *transformSink) WriteBatch(ctx context.Context, batch Batch) error {
+	out := make(Batch, 0, len(batch))
+	for _, m := range batch {
+		out = append(out, ts.transform(ctx, m)...)
+	}
+	return WriteBatch(ctx, ts.Sink, out)
+}
+
+func (ts *transformSink) Flush(ctx context.Context) error {
+	return FlushSink(ctx, ts.Sink)
+}
+
+func (ts *transformSink) Close() error {
+	return CloseSink(ts.Sink)
+}
+
+func (ts *transformSink) Healthy(ctx context.Context) error {
+	return CheckHealth(ctx, ts.Sink)
+}
+
+// withIdentity returns a copy of m with a new name and tags. Metrics are always
+// copied before they're changed, since the originals may be shared. Tags that a strict
+// DefaultRegistry hasn't declared for the metric are left off.
+func withIdentity(m Metric, name string, tags Tags) Metric {
+	tags = DefaultRegistry.declaredTags(name, tags)
+	switch m := m.(type) {
+	case *Counter:
+		c := *m
+		c.name, c.tags = name, tags
+		return &c
+	case *Timer:
+		t := *m
+		t.name, t.tags = name, tags
+		return &t
+	case *Gauge:
+		g := *m
+		g.name, g.tags = name, tags
+		return &g
+	case *Histogram:
+		h := *m
+		h.name, h.tags = name, tags
+		return &h
+	}
+	return m
+}
+
+// tagsOf returns the tags of any of the metric types in this package
+func tagsOf(m Metric) Tags {
+	if t, ok := m.(interface{ Tags() Tags }); ok {
+		return t.Tags()
+	}
+	return nil
+}
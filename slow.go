@@ -0,0 +1,207 @@
+package stats
+
+// SlowRequests captures the requests that take too long, with everything they
+// recorded, so that you can see where the time went in a particular request rather
+// than on average:
+//
+//	router.Use(stats.Metrics(sink))
+//	router.Use(stats.SlowRequests(stats.SlowRequestPolicy{
+//	    Threshold: 2 * time.Second,
+//	    Routes:    map[string]time.Duration{"POST /upload": 30 * time.Second},
+//	}))
+//
+// Each slow request is logged as a structured record (a SlowRequest), by default as a
+// warning to slog.Default(). Timers that are still running when the handler returns
+// are included at their elapsed time, and listed in Unfinished.
+//
+// Records are rate limited, so that an incident that makes everything slow doesn't
+// flood the logs. Records that are suppressed are counted in the next one that isn't.
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SlowRequestPolicy configures SlowRequests. Zero fields get the defaults noted.
+type SlowRequestPolicy struct {
+	Threshold    time.Duration                                 // Requests slower than this are captured (default 1s)
+	Routes       map[string]time.Duration                      // Thresholds for particular routes, in place of Threshold
+	Route        func(*http.Request) string                    // Names the route (default: the ServeMux pattern, or the path)
+	TraceID      func(*http.Request) string                    // Finds the trace ID (default: from the traceparent or X-Cloud-Trace-Context header)
+	MaxPerSecond float64                                       // Records per second (default 1)
+	Burst        float64                                       // Records that can be made at once, in seconds' worth of MaxPerSecond (default 10)
+	Logger       *slog.Logger                                  // Where records are logged (default slog.Default())
+	Handler      func(ctx context.Context, record SlowRequest) // Called with each record, in place of logging it
+}
+
+func (p SlowRequestPolicy) withDefaults() SlowRequestPolicy {
+	if p.Threshold <= 0 {
+		p.Threshold = time.Second
+	}
+	if p.Route == nil {
+		p.Route = requestRoute
+	}
+	if p.TraceID == nil {
+		p.TraceID = TraceID
+	}
+	if p.MaxPerSecond <= 0 {
+		p.MaxPerSecond = 1
+	}
+	if p.Burst <= 0 {
+		p.Burst = 10
+	}
+	return p
+}
+
+// SlowRequest is the record of a slow request.
+type SlowRequest struct {
+	Method     string
+	Route      string
+	Path       string
+	Status     int
+	TraceID    string
+	Start      time.Time
+	Duration   time.Duration
+	Threshold  time.Duration
+	Counters   map[string]int
+	Timers     map[string]time.Duration
+	Unfinished []string // Timers that were still running
+	Suppressed int64    // Slow requests that weren't recorded since the last record, because of the rate limit
+}
+
+// LogValue lays the record out for log/slog.
+func (s SlowRequest) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("method", s.Method),
+		slog.String("route", s.Route),
+		slog.String("path", s.Path),
+		slog.Int("status", s.Status),
+		slog.Duration("duration", s.Duration),
+		slog.Duration("threshold", s.Threshold),
+	}
+	if s.TraceID != "" {
+		attrs = append(attrs, slog.String("trace_id", s.TraceID))
+	}
+	attrs = append(attrs, slog.Any("counters", s.Counters), slog.Any("timers", s.Timers))
+	if len(s.Unfinished) > 0 {
+		attrs = append(attrs, slog.Any("unfinished", s.Unfinished))
+	}
+	if s.Suppressed > 0 {
+		attrs = append(attrs, slog.Int64("suppressed", s.Suppressed))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// SlowRequests is middleware that records requests slower than the policy's threshold.
+// It has to come after Metrics to include the request's metrics.
+func SlowRequests(policy SlowRequestPolicy) func(http.Handler) http.Handler {
+	policy = policy.withDefaults()
+	limiter := &recordLimiter{bucket: newTokenBucket(policy.MaxPerSecond, policy.Burst, time.Now())}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rw := wrapResponse(w)
+			next.ServeHTTP(rw, r)
+			elapsed := time.Since(start)
+
+			// the route is only known once the request has been routed
+			route := policy.Route(r)
+			threshold, ok := policy.Routes[route]
+			if !ok {
+				threshold = policy.Threshold
+			}
+			if elapsed <= threshold {
+				return
+			}
+			suppressed, allowed := limiter.allow(time.Now())
+			if !allowed {
+				return
+			}
+			record := SlowRequest{
+				Method:     r.Method,
+				Route:      route,
+				Path:       r.URL.Path,
+				Status:     rw.Status(),
+				TraceID:    policy.TraceID(r),
+				Start:      start,
+				Duration:   elapsed,
+				Threshold:  threshold,
+				Suppressed: suppressed,
+			}
+			if rs, ok := lockStats(r.Context()); ok {
+				record.Counters, record.Timers, record.Unfinished = rs.breakdown()
+				rs.mu.Unlock()
+			}
+			if policy.Handler != nil {
+				policy.Handler(r.Context(), record)
+				return
+			}
+			logger := policy.Logger
+			if logger == nil {
+				logger = slog.Default()
+			}
+			logger.LogAttrs(r.Context(), slog.LevelWarn, "Slow request", slog.Any("request", record))
+		})
+	}
+}
+
+// breakdown returns the request's counters and timers, including the running timers at
+// their elapsed time
+func (rs *requestStats) breakdown() (map[string]int, map[string]time.Duration, []string) {
+	s := rs.snapshot()
+	counters, timers := s.Counters(), s.Timers()
+	var unfinished []string
+	now := rs.now().UnixNano()
+	for bucket, t := range rs.timers {
+		if t.Started() && !t.Finished() {
+			timers[bucket] = time.Duration(now - t.startTime)
+			unfinished = append(unfinished, bucket)
+		}
+	}
+	sort.Strings(unfinished)
+	return counters, timers, unfinished
+}
+
+// recordLimiter rate limits records, counting the ones it turns away
+type recordLimiter struct {
+	mu         sync.Mutex
+	bucket     *tokenBucket
+	suppressed int64
+}
+
+// allow returns whether a record can be made now, and if so, how many were suppressed
+// since the last one
+func (l *recordLimiter) allow(now time.Time) (int64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.bucket.available(now) < 1 {
+		l.suppressed++
+		return 0, false
+	}
+	l.bucket.take(1)
+	suppressed := l.suppressed
+	l.suppressed = 0
+	return suppressed, true
+}
+
+// TraceID returns the trace ID of the request from its W3C traceparent header, or
+// from Google Cloud's X-Cloud-Trace-Context header. It's empty if there isn't one.
+func TraceID(r *http.Request) string {
+	if tp := r.Header.Get("traceparent"); tp != "" {
+		// version-traceid-parentid-flags
+		if parts := strings.Split(tp, "-"); len(parts) == 4 && len(parts[1]) == 32 {
+			return parts[1]
+		}
+	}
+	if tc := r.Header.Get("X-Cloud-Trace-Context"); tc != "" {
+		// TRACE_ID/SPAN_ID;o=OPTIONS
+		id, _, _ := strings.Cut(tc, "/")
+		return id
+	}
+	return ""
+}
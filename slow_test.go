@@ -0,0 +1,92 @@
+package stats
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowRequests(t *testing.T) {
+	var records []SlowRequest
+	mw := chain(Metrics(nil), SlowRequests(SlowRequestPolicy{
+		Threshold: time.Millisecond,
+		Routes:    map[string]time.Duration{"/upload": time.Hour},
+		Handler:   func(ctx context.Context, record SlowRequest) { records = append(records, record) },
+	}))
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		Increment(r.Context(), "test/counter")
+		StartTimer(r.Context(), "test/finished")
+		FinishTimer(r.Context(), "test/finished")
+		StartTimer(r.Context(), "test/running")
+		time.Sleep(5 * time.Millisecond)
+		w.WriteHeader(http.StatusCreated)
+	}
+
+	r := httptest.NewRequest("POST", "/items", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	serveRequest(mw, r, slow)
+	serveRequest(mw, httptest.NewRequest("POST", "/upload", nil), slow)
+	serve(mw, func(w http.ResponseWriter, r *http.Request) {})
+
+	if len(records) != 1 {
+		t.Fatalf("Expected one slow request, got %d", len(records))
+	}
+	rec := records[0]
+	if rec.Route != "/items" || rec.Status != http.StatusCreated || rec.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Unexpected request details %+v", rec)
+	}
+	if rec.Counters["test/counter"] != 1 || len(rec.Timers) != 2 || rec.Timers["test/running"] < 5*time.Millisecond {
+		t.Errorf("Expected the request's metrics, got %v and %v", rec.Counters, rec.Timers)
+	}
+	if len(rec.Unfinished) != 1 || rec.Unfinished[0] != "test/running" {
+		t.Errorf("Expected the running timer to be unfinished, got %v", rec.Unfinished)
+	}
+}
+
+func TestSlowRequestLog(t *testing.T) {
+	var buf bytes.Buffer
+	mw := chain(Metrics(nil), SlowRequests(SlowRequestPolicy{
+		Threshold: time.Nanosecond,
+		Logger:    slog.New(slog.NewJSONHandler(&buf, nil)),
+	}))
+	serve(mw, func(w http.ResponseWriter, r *http.Request) {
+		Increment(r.Context(), "test/counter")
+		time.Sleep(time.Millisecond)
+	})
+	out := buf.String()
+	if !strings.Contains(out, `"msg":"Slow request"`) || !strings.Contains(out, `"counters":{"test/counter":1}`) {
+		t.Errorf("Unexpected log record %s", out)
+	}
+}
+
+func TestRecordLimiter(t *testing.T) {
+	now := time.Now()
+	l := &recordLimiter{bucket: newTokenBucket(1, 1, now)}
+	if _, ok := l.allow(now); !ok {
+		t.Errorf("First record should be allowed")
+	}
+	for i := 0; i < 2; i++ {
+		if _, ok := l.allow(now); ok {
+			t.Errorf("Records beyond the limit should be suppressed")
+		}
+	}
+	if suppressed, ok := l.allow(now.Add(time.Second)); !ok || suppressed != 2 {
+		t.Errorf("Expected a record with 2 suppressed, got %d", suppressed)
+	}
+}
+
+func TestTraceID(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	if id := TraceID(r); id != "" {
+		t.Errorf("Expected no trace ID, got %s", id)
+	}
+	r.Header.Set("X-Cloud-Trace-Context", "105445aa7843bc8bf206b12000100000/1;o=1")
+	if id := TraceID(r); id != "105445aa7843bc8bf206b12000100000" {
+		t.Errorf("Unexpected trace ID %s", id)
+	}
+}
@@ -0,0 +1,192 @@
+package stats
+
+// Snapshots are copies of a request's metrics, for code that wants to look at them
+// rather than send them somewhere. Snapshot reads them in the middle of a request,
+// and flush hooks get them once the request is over:
+//
+//	router.Use(stats.Metrics(sink, stats.OnFlush(func(ctx context.Context, s stats.RequestSnapshot) {
+//	    if d, ok := s.Timer("db/query"); ok && d > time.Second {
+//	        ...
+//	    }
+//	})))
+//
+// Flush hooks are called in the order they were given, after the request's metrics
+// have been handed to the sink, on the goroutine that flushes the request. A hook that
+// takes a long time holds up the release of the request's resources, so hooks with
+// real work to do should do it on their own goroutine.
+//
+// Snapshots are keyed by bucket, as passed to Increment, StartTimer and so on. Counters
+// are Estimates (see sampling.go), and timers are only included once they're finished.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// RequestSnapshot is an immutable copy of a request's metrics.
+type RequestSnapshot struct {
+	counters   map[string]int
+	timers     map[string]time.Duration
+	gauges     map[string]int
+	histograms map[string][]time.Duration
+}
+
+// A FlushHook is called with each request's metrics once they've been flushed. See
+// OnFlush.
+type FlushHook func(ctx context.Context, snapshot RequestSnapshot)
+
+// MetricsWithHooks is Metrics with an OnFlush option for each of the hooks.
+func MetricsWithHooks(sink Sink, hooks ...FlushHook) func(http.Handler) http.Handler {
+	opts := make([]Option, len(hooks))
+	for i, hook := range hooks {
+		opts[i] = OnFlush(hook)
+	}
+	return Metrics(sink, opts...)
+}
+
+// Snapshot returns a copy of the request's metrics as they are now.
+func Snapshot(ctx context.Context) (RequestSnapshot, error) {
+	rs, ok := lockStats(ctx)
+	if !ok {
+		return RequestSnapshot{}, RequestMetricsNotInitted
+	}
+	defer rs.mu.Unlock()
+	return rs.snapshot(), nil
+}
+
+// Counter returns the count in the counter bucket, if anything was counted.
+func (s RequestSnapshot) Counter(bucket string) (int, bool) {
+	n, ok := s.counters[bucket]
+	return n, ok
+}
+
+// Timer returns the duration of the finished timer bucket.
+func (s RequestSnapshot) Timer(bucket string) (time.Duration, bool) {
+	d, ok := s.timers[bucket]
+	return d, ok
+}
+
+// Gauge returns the value of the gauge bucket.
+func (s RequestSnapshot) Gauge(bucket string) (int, bool) {
+	v, ok := s.gauges[bucket]
+	return v, ok
+}
+
+// Histogram returns a copy of the observations in the histogram bucket.
+func (s RequestSnapshot) Histogram(bucket string) ([]time.Duration, bool) {
+	obs, ok := s.histograms[bucket]
+	return append([]time.Duration(nil), obs...), ok
+}
+
+// Counters returns a copy of all of the counts, by bucket.
+func (s RequestSnapshot) Counters() map[string]int {
+	return copyMap(s.counters)
+}
+
+// Timers returns a copy of all of the finished timers, by bucket.
+func (s RequestSnapshot) Timers() map[string]time.Duration {
+	return copyMap(s.timers)
+}
+
+// Gauges returns a copy of all of the gauges, by bucket.
+func (s RequestSnapshot) Gauges() map[string]int {
+	return copyMap(s.gauges)
+}
+
+// Histograms returns a copy of all of the histograms, by bucket.
+func (s RequestSnapshot) Histograms() map[string][]time.Duration {
+	m := make(map[string][]time.Duration, len(s.histograms))
+	for k, v := range s.histograms {
+		m[k] = append([]time.Duration(nil), v...)
+	}
+	return m
+}
+
+func copyMap[V any](src map[string]V) map[string]V {
+	m := make(map[string]V, len(src))
+	for k, v := range src {
+		m[k] = v
+	}
+	return m
+}
+
+func (rs *requestStats) snapshot() RequestSnapshot {
+	s := RequestSnapshot{
+		counters:   make(map[string]int, len(rs.counters)),
+		timers:     make(map[string]time.Duration, len(rs.finished)+len(rs.timers)),
+		gauges:     make(map[string]int, len(rs.gauges)),
+		histograms: make(map[string][]time.Duration, len(rs.histograms)),
+	}
+	for bucket, c := range rs.counters {
+		if c.Data() > 0 {
+			s.counters[bucket] = c.Estimate()
+		}
+	}
+	for bucket, d := range rs.finished {
+		s.timers[bucket] = d
+	}
+	for bucket, t := range rs.timers {
+		if t.Finished() {
+			s.timers[bucket] = time.Duration(t.Duration())
+		}
+	}
+	for bucket, g := range rs.gauges {
+		s.gauges[bucket] = g.Value()
+	}
+	for bucket, h := range rs.histograms {
+		s.histograms[bucket] = append([]time.Duration(nil), h.Observations()...)
+	}
+	return s
+}
+
+// onFlush adds a hook for the ctx's request only, to be called after the pipeline's
+// hooks. Middleware uses it to act on the request's final metrics. It returns false,
+// and the hook won't be called, if the request has no metrics or if they're already
+// being flushed.
+func onFlush(ctx context.Context, hook FlushHook) bool {
+	rs, ok := lockStats(ctx)
+	if !ok {
+		return false
+	}
+	defer rs.mu.Unlock()
+	if rs.hooksRun {
+		return false
+	}
+	rs.hooks = append(rs.hooks, hook)
+	if !rs.flushing {
+		// there's no sink, so nothing is waiting to flush the request yet
+		rs.flushing = true
+		waitForRequestDone(rs.ctx, nil)
+	}
+	return true
+}
+
+// runFlushHooks calls the hooks of the ctx's pipeline, and then the request's own, with
+// the request's metrics. Panics in hooks are reported as errors, so that they don't
+// take the process down.
+func runFlushHooks(ctx context.Context, rs *requestStats) {
+	rs.mu.Lock()
+	rs.hooksRun = true // no more can be added
+	hooks := rs.hooks
+	if p, ok := pipelineFromContext(ctx); ok && len(p.hooks) > 0 {
+		hooks = append(p.hooks[:len(p.hooks):len(p.hooks)], rs.hooks...)
+	}
+	if len(hooks) == 0 {
+		rs.mu.Unlock()
+		return
+	}
+	snapshot := rs.snapshot()
+	rs.mu.Unlock()
+	for _, hook := range hooks {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					reportError(ctx, fmt.Errorf("%v", r), "Flush hook panicked")
+				}
+			}()
+			hook(ctx, snapshot)
+		}()
+	}
+}
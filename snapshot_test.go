@@ -0,0 +1,93 @@
+package stats
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	if _, err := Snapshot(context.Background()); err != RequestMetricsNotInitted {
+		t.Errorf("Expected RequestMetricsNotInitted, got %v", err)
+	}
+	ctx := requestContextUsingMetrics()
+	Increment(ctx, "test/counter")
+	Increment(ctx, "test/counter")
+	StartTimer(ctx, "test/timer")
+	FinishTimer(ctx, "test/timer")
+	StartTimer(ctx, "test/running")
+	SetGauge(ctx, "test/gauge", 7)
+	Observe(ctx, "test/histogram", time.Millisecond)
+
+	s, err := Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if n, ok := s.Counter("test/counter"); !ok || n != 2 {
+		t.Errorf("Expected a count of 2, got %d", n)
+	}
+	if d, ok := s.Timer("test/timer"); !ok || d <= 0 {
+		t.Errorf("Expected the finished timer, got %s", d)
+	}
+	if _, ok := s.Timer("test/running"); ok {
+		t.Errorf("Unfinished timers shouldn't be in the snapshot")
+	}
+	if v, _ := s.Gauge("test/gauge"); v != 7 {
+		t.Errorf("Expected a gauge of 7, got %d", v)
+	}
+
+	// the snapshot doesn't change with the request, or when its copies are changed
+	Increment(ctx, "test/counter")
+	Observe(ctx, "test/histogram", time.Second)
+	s.Counters()["test/counter"] = 100
+	if n, _ := s.Counter("test/counter"); n != 2 {
+		t.Errorf("Snapshot changed, count is now %d", n)
+	}
+	if obs, _ := s.Histogram("test/histogram"); len(obs) != 1 {
+		t.Errorf("Snapshot changed, histogram is now %v", obs)
+	}
+}
+
+func TestFlushHooks(t *testing.T) {
+	snapshots := make(chan RequestSnapshot, 2)
+	hook := func(ctx context.Context, s RequestSnapshot) {
+		snapshots <- s
+	}
+	panicky := func(ctx context.Context, s RequestSnapshot) {
+		panic("oops")
+	}
+	errs := make(chan error, 1)
+	for _, sink := range []Sink{nopSink{}, nil} {
+		handler := Metrics(sink, OnFlush(panicky), OnFlush(hook), WithErrorHandler(func(ctx context.Context, err error) {
+			errs <- err
+		}))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Increment(r.Context(), "test/counter")
+			StartTimer(r.Context(), "test/timer")
+			FinishTimer(r.Context(), "test/timer")
+			StartTimer(r.Context(), "test/unfinished")
+		}))
+		ctx, cancel := context.WithCancel(context.Background())
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+		cancel()
+
+		select {
+		case s := <-snapshots:
+			timers := s.Timers()
+			if n, _ := s.Counter("test/counter"); n != 1 || len(timers) != 2 {
+				t.Errorf("Expected a counter and both timers (with sink %v), got %v and %v", sink, s.Counters(), timers)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Flush hook wasn't called (with sink %v)", sink)
+		}
+		select {
+		case err := <-errs:
+			if pe, ok := err.(*PipelineError); !ok || pe.Message != "Flush hook panicked" {
+				t.Errorf("Expected the panic to be reported, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Panic in flush hook wasn't reported")
+		}
+	}
+}
@@ -0,0 +1,468 @@
+package stats
+
+// A SpillSink keeps metrics on local disk until the backend has them, so that they
+// survive both backend outages and process restarts:
+//
+//	spill, err := stats.Spill(stackdriver.Sink, stats.SpillPolicy{Dir: "/var/lib/myapp/metrics"})
+//	if err != nil {
+//	    ...
+//	}
+//	defer spill.Close()
+//	router.Use(stats.Metrics(spill))
+//
+// Every batch written to a SpillSink is appended to a write-ahead log in Dir, and a
+// background goroutine replays the log to the wrapped sink in order. A batch the sink
+// fails to write is tried again, every ReplayInterval, until it succeeds; nothing after
+// it is written in the meantime. A batch the sink rejects for good (with errors marked
+// as not retryable, see Retryable) is reported and dropped instead. The log is a series of segment files of JSON lines, one line
+// per batch. Once every batch in a segment has been acknowledged by the sink, the
+// segment is deleted. The position in the log is kept in a file next to the segments,
+// so a restarted process picks up where the last one left off.
+//
+// Delivery is at least once: a crash between a write to the sink and the update of the
+// position means the batch is written again on restart. When the log reaches MaxSize,
+// new writes are rejected with SpillFull until the sink catches up.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	SpillFull   = errors.New("Spill log is full, metrics were not written")
+	SpillClosed = errors.New("Spill log is closed")
+	NoSpillDir  = errors.New("No directory given for the spill log")
+)
+
+const (
+	spillSegmentPrefix = "segment-"
+	spillSegmentSuffix = ".wal"
+	spillPositionFile  = "position"
+)
+
+// SpillPolicy configures a SpillSink. Zero fields other than Dir get the defaults noted.
+type SpillPolicy struct {
+	Dir            string        // Directory for the log; created if need be. Required.
+	SegmentSize    int64         // Bytes per segment before a new one is started (default 4MB)
+	MaxSize        int64         // Bytes in all segments, beyond which writes are rejected (default 256MB)
+	ReplayInterval time.Duration // Time between attempts to replay to a failing sink (default 10s)
+	NoSync         bool          // Don't fsync each write. Faster, but a machine crash can lose data.
+}
+
+func (p SpillPolicy) withDefaults() SpillPolicy {
+	if p.SegmentSize <= 0 {
+		p.SegmentSize = 4 << 20
+	}
+	if p.MaxSize <= 0 {
+		p.MaxSize = 256 << 20
+	}
+	if p.ReplayInterval <= 0 {
+		p.ReplayInterval = 10 * time.Second
+	}
+	return p
+}
+
+// SpillSink is a write-ahead log in front of a Sink. See the top of spill.go.
+type SpillSink struct {
+	sink   Sink
+	policy SpillPolicy
+
+	mu         sync.Mutex // guards the fields below, which belong to the writer
+	segments   []int64    // ids of the segments on disk, oldest first
+	sizes      map[int64]int64
+	active     *os.File // the segment being appended to, which is always the last one
+	activeID   int64
+	total      int64
+	full       bool // a write has been rejected since space was last freed
+	closed     bool
+	nextReplay chan struct{}
+
+	// replay position; only used by the replay goroutine, and at startup
+	readID     int64
+	readOffset int64
+
+	flushes chan chan error
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Spill wraps sink in a SpillSink logging to policy.Dir. Anything left in the log by a
+// previous process is replayed. The sink's own name translation is applied to what's
+// written to it.
+func Spill(sink Sink, policy SpillPolicy) (*SpillSink, error) {
+	if policy.Dir == "" {
+		return nil, NoSpillDir
+	} else if err := os.MkdirAll(policy.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &SpillSink{
+		sink:       withNameTranslation(sink),
+		policy:     policy.withDefaults(),
+		sizes:      make(map[int64]int64),
+		nextReplay: make(chan struct{}, 1),
+		flushes:    make(chan chan error),
+		done:       make(chan struct{}),
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// open finds the existing segments and position, and starts a new segment to append to
+func (s *SpillSink) open() error {
+	entries, err := os.ReadDir(s.policy.Dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, spillSegmentPrefix) || !strings.HasSuffix(name, spillSegmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, spillSegmentPrefix), spillSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, id)
+		s.sizes[id] = info.Size()
+		s.total += info.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+	if data, err := os.ReadFile(s.path(spillPositionFile)); err == nil {
+		fmt.Sscanf(string(data), "%d %d", &s.readID, &s.readOffset)
+	}
+	return s.rotate()
+}
+
+func (s *SpillSink) path(name string) string {
+	return filepath.Join(s.policy.Dir, name)
+}
+
+func (s *SpillSink) segmentPath(id int64) string {
+	return s.path(fmt.Sprintf("%s%020d%s", spillSegmentPrefix, id, spillSegmentSuffix))
+}
+
+// rotate closes the active segment and starts a new one. It must be called with the lock held.
+func (s *SpillSink) rotate() error {
+	id := int64(1)
+	if len(s.segments) > 0 {
+		id = s.segments[len(s.segments)-1] + 1
+	}
+	f, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if s.active != nil {
+		s.active.Close()
+	}
+	s.active, s.activeID = f, id
+	s.segments = append(s.segments, id)
+	s.sizes[id] = 0
+	return nil
+}
+
+func (s *SpillSink) WriteCounters(ctx context.Context, counters ...*Counter) error {
+	batch := make(Batch, len(counters))
+	for i, c := range counters {
+		batch[i] = c
+	}
+	return s.WriteBatch(ctx, batch)
+}
+
+func (s *SpillSink) WriteTimers(ctx context.Context, timers ...*Timer) error {
+	batch := make(Batch, len(timers))
+	for i, t := range timers {
+		batch[i] = t
+	}
+	return s.WriteBatch(ctx, batch)
+}
+
+func (s *SpillSink) WriteGauges(ctx context.Context, gauges ...*Gauge) error {
+	batch := make(Batch, len(gauges))
+	for i, g := range gauges {
+		batch[i] = g
+	}
+	return s.WriteBatch(ctx, batch)
+}
+
+func (s *SpillSink) WriteHistograms(ctx context.Context, histograms ...*Histogram) error {
+	batch := make(Batch, len(histograms))
+	for i, h := range histograms {
+		batch[i] = h
+	}
+	return s.WriteBatch(ctx, batch)
+}
+
+// WriteBatch appends the batch to the log. Once it returns nil, the batch will be
+// delivered to the sink eventually, even if the process restarts in between.
+func (s *SpillSink) WriteBatch(ctx context.Context, batch Batch) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	line, err := encodeSpillBatch(batch)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := int64(len(line))
+	if s.closed {
+		return SpillClosed
+	} else if s.total+n > s.policy.MaxSize {
+		s.full = true
+		return SpillFull
+	} else if size := s.sizes[s.activeID]; size > 0 && size+n > s.policy.SegmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.active.Write(line); err != nil {
+		s.active.Truncate(s.sizes[s.activeID]) // don't leave part of a line behind
+		return err
+	} else if !s.policy.NoSync {
+		if err := s.active.Sync(); err != nil {
+			return err
+		}
+	}
+	s.sizes[s.activeID] += n
+	s.total += n
+	select {
+	case s.nextReplay <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Pending is the number of bytes in the log, including batches that have been
+// delivered from segments that are still in use.
+func (s *SpillSink) Pending() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total
+}
+
+// Flush replays everything in the log, and then flushes the wrapped sink if it's a
+// Flusher. If the sink fails, its error is returned and the log is left in place.
+func (s *SpillSink) Flush(ctx context.Context) error {
+	reply := make(chan error, 1)
+	select {
+	case s.flushes <- reply:
+	case <-s.done:
+		return SpillClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-reply:
+		if err != nil {
+			return err
+		}
+		return FlushSink(ctx, s.sink)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops replaying and closes the log. Anything that hasn't been delivered stays
+// in the log for the next process. The wrapped sink is closed if it's a Closer.
+func (s *SpillSink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return SpillClosed
+	}
+	s.closed = true
+	s.mu.Unlock()
+	close(s.done)
+	s.wg.Wait()
+	s.mu.Lock()
+	err := s.active.Close()
+	s.mu.Unlock()
+	if cerr := CloseSink(s.sink); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// Healthy returns SpillFull if the log has been rejecting writes, and otherwise asks the wrapped sink.
+func (s *SpillSink) Healthy(ctx context.Context) error {
+	s.mu.Lock()
+	full := s.full
+	s.mu.Unlock()
+	if full {
+		return SpillFull
+	}
+	return CheckHealth(ctx, s.sink)
+}
+
+func (s *SpillSink) run() {
+	defer s.wg.Done()
+	ctx := context.Background()
+	ticker := time.NewTicker(s.policy.ReplayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case reply := <-s.flushes:
+			reply <- s.replay(ctx)
+		case <-s.nextReplay:
+			s.replay(ctx)
+		case <-ticker.C:
+			s.replay(ctx)
+		}
+	}
+}
+
+// replay delivers everything in the log that hasn't been delivered, oldest first,
+// deleting segments as they're finished. It stops at the first batch the sink fails on.
+func (s *SpillSink) replay(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		id, end, active := s.segments[0], s.sizes[s.segments[0]], s.segments[0] == s.activeID
+		s.mu.Unlock()
+		if id != s.readID {
+			s.readID, s.readOffset = id, 0
+		}
+		if s.readOffset < end {
+			if err := s.replaySegment(ctx, id, end); err != nil {
+				return err
+			}
+		}
+		if active {
+			return nil
+		}
+		s.mu.Lock()
+		s.segments = s.segments[1:]
+		s.total -= s.sizes[id]
+		s.full = false
+		delete(s.sizes, id)
+		s.mu.Unlock()
+		if err := os.Remove(s.segmentPath(id)); err != nil {
+			reportError(ctx, err, "Error removing delivered metrics segment %s", s.segmentPath(id))
+		}
+	}
+}
+
+// replaySegment delivers the batches in [readOffset, end) of a segment. An incomplete
+// line at the end (from a crash mid-write) is skipped over.
+func (s *SpillSink) replaySegment(ctx context.Context, id, end int64) error {
+	f, err := os.Open(s.segmentPath(id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data := make([]byte, end-s.readOffset)
+	if _, err := f.ReadAt(data, s.readOffset); err != nil {
+		return err
+	}
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			s.readOffset = end
+			return nil
+		}
+		batch, err := decodeSpillBatch(line)
+		if err != nil {
+			reportError(ctx, err, "Skipping corrupt metrics batch in %s", s.segmentPath(id))
+		} else if err := WriteBatch(ctx, s.sink, batch); err != nil && isPermanent(err) {
+			reportError(ctx, err, "Dropping spilled metrics batch in %s, which the sink rejected", s.segmentPath(id))
+		} else if err != nil {
+			warnf(ctx, "Error replaying spilled metrics, will try again: %s", err)
+			return err
+		}
+		s.readOffset += int64(len(line))
+		s.savePosition(ctx)
+	}
+}
+
+// savePosition records the replay position, replacing the position file atomically
+func (s *SpillSink) savePosition(ctx context.Context) {
+	tmp := s.path(spillPositionFile + ".tmp")
+	err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", s.readID, s.readOffset)), 0o644)
+	if err == nil {
+		err = os.Rename(tmp, s.path(spillPositionFile))
+	}
+	if err != nil {
+		reportError(ctx, err, "Error saving spilled metrics position")
+	}
+}
+
+// spillMetric is the log form of a metric
+type spillMetric struct {
+	Kind         string          `json:"kind"`
+	Name         string          `json:"name"`
+	Tags         Tags            `json:"tags,omitempty"`
+	Value        int             `json:"value,omitempty"`
+	Rate         float64         `json:"rate,omitempty"`
+	Observations []time.Duration `json:"observations,omitempty"`
+}
+
+func encodeSpillBatch(batch Batch) ([]byte, error) {
+	records := make([]spillMetric, 0, len(batch))
+	for _, m := range batch {
+		rec := spillMetric{Name: m.Name(), Tags: tagsOf(m), Value: m.Data(), Rate: rateOf(m)}
+		switch m := m.(type) {
+		case *Counter:
+			rec.Kind = KindCounter.String()
+		case *Timer:
+			rec.Kind = KindTimer.String()
+		case *Gauge:
+			rec.Kind = KindGauge.String()
+		case *Histogram:
+			rec.Kind = KindHistogram.String()
+			rec.Observations = m.Observations()
+		default:
+			return nil, fmt.Errorf("Can't spill metric %s of type %T", m.Name(), m)
+		}
+		records = append(records, rec)
+	}
+	line, err := json.Marshal(records)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+func decodeSpillBatch(line []byte) (Batch, error) {
+	var records []spillMetric
+	if err := json.Unmarshal(line, &records); err != nil {
+		return nil, err
+	}
+	batch := make(Batch, 0, len(records))
+	for _, rec := range records {
+		base := metric{name: rec.Name, data: rec.Value, tags: rec.Tags, rate: rec.Rate}
+		switch rec.Kind {
+		case KindCounter.String():
+			batch = append(batch, &Counter{metric: base})
+		case KindTimer.String():
+			batch = append(batch, &Timer{metric: base})
+		case KindGauge.String():
+			batch = append(batch, &Gauge{metric: base})
+		case KindHistogram.String():
+			batch = append(batch, &Histogram{metric: base, observations: rec.Observations})
+		default:
+			return nil, fmt.Errorf("Unknown metric kind %q", rec.Kind)
+		}
+	}
+	return batch, nil
+}
@@ -0,0 +1,130 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSpillSinkReplaysAfterOutage(t *testing.T) {
+	ctx := context.Background()
+	down := &flakySink{failures: 1, err: errors.New("unavailable")}
+	s, err := Spill(down, SpillPolicy{Dir: t.TempDir(), SegmentSize: 1, ReplayInterval: time.Hour, NoSync: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer s.Close()
+	for i := 1; i <= 3; i++ {
+		if err := s.WriteCounters(ctx, testCounter("test/counter", i)); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	s.Flush(ctx) // the first flush may be the one that fails
+	if err := s.Flush(ctx); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(down.counters) != 3 {
+		t.Fatalf("Expected 3 counters once the sink recovered, got %d", len(down.counters))
+	}
+	for i, c := range down.counters {
+		if c.Data() != i+1 {
+			t.Errorf("Expected the counters in order, got %d at %d", c.Data(), i)
+		}
+	}
+	// with one batch per segment, everything but the active segment is gone
+	if files, _ := filepath.Glob(filepath.Join(s.policy.Dir, "*.wal")); len(files) != 1 {
+		t.Errorf("Expected the delivered segments to be removed, got %v", files)
+	}
+}
+
+func TestSpillSinkDropsRejectedBatches(t *testing.T) {
+	ctx := context.Background()
+	rejecting := &flakySink{failures: 1, err: MarkRetryable(errors.New("400"), false)}
+	s, err := Spill(rejecting, SpillPolicy{Dir: t.TempDir(), ReplayInterval: time.Hour, NoSync: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer s.Close()
+	for i := 1; i <= 2; i++ {
+		if err := s.WriteCounters(ctx, testCounter("test/counter", i)); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(rejecting.counters) != 1 || rejecting.counters[0].Data() != 2 {
+		t.Errorf("Expected the rejected batch to be skipped, got %v", rejecting.counters)
+	}
+	// the rejected batch isn't replayed again
+	if err := s.Flush(ctx); err != nil || rejecting.attempts() != 2 {
+		t.Errorf("Expected no more writes, got %d in all (%v)", rejecting.attempts(), err)
+	}
+}
+
+func TestSpillSinkResumesOnRestart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	down := &flakySink{failures: 1000, err: errors.New("unavailable")}
+	s, err := Spill(down, SpillPolicy{Dir: dir, ReplayInterval: time.Hour, NoSync: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	g := makeGauge("test/gauge")
+	g.Set(4)
+	s.WriteBatch(ctx, Batch{testCounter("test/counter", 2), g, testHistogram("test/histogram", time.Second)})
+	s.Close()
+
+	up := &capableSink{}
+	s, err = Spill(up, SpillPolicy{Dir: dir, ReplayInterval: time.Hour, NoSync: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer s.Close()
+	if err := s.Flush(ctx); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(up.counters) != 1 || up.counters[0].Data() != 2 {
+		t.Errorf("Expected the counter from the last run, got %v", up.counters)
+	}
+	if len(up.gauges) != 1 || up.gauges[0].Value() != 4 {
+		t.Errorf("Expected the gauge from the last run, got %v", up.gauges)
+	}
+	if len(up.histograms) != 1 || up.histograms[0].Observations()[0] != time.Second {
+		t.Errorf("Expected the histogram from the last run, got %v", up.histograms)
+	}
+
+	// a third run has nothing left to deliver
+	s.Close()
+	again := &recordingSink{}
+	s, _ = Spill(again, SpillPolicy{Dir: dir, ReplayInterval: time.Hour, NoSync: true})
+	s.Flush(ctx)
+	if len(again.counters) != 0 {
+		t.Errorf("Expected acknowledged batches not to be replayed, got %v", again.counters)
+	}
+}
+
+func TestSpillSinkFull(t *testing.T) {
+	ctx := context.Background()
+	down := &flakySink{failures: 1000, err: errors.New("unavailable")}
+	s, err := Spill(down, SpillPolicy{Dir: t.TempDir(), MaxSize: 100, ReplayInterval: time.Hour, NoSync: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer s.Close()
+	for i := 0; i < 10 && err == nil; i++ {
+		err = s.WriteCounters(ctx, testCounter("test/counter", 1))
+	}
+	if err != SpillFull {
+		t.Errorf("Expected %s, got %v", SpillFull, err)
+	}
+	if err := s.Healthy(ctx); err != SpillFull {
+		t.Errorf("Expected an unhealthy sink, got %v", err)
+	}
+	if _, err := os.Stat(s.path(spillPositionFile)); err == nil {
+		t.Errorf("Nothing was delivered, so there shouldn't be a position yet")
+	}
+}
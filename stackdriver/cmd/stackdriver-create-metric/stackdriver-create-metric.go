@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"github.com/efixler/stats"
 	"github.com/efixler/stats/stackdriver"
 )
 
@@ -18,6 +19,8 @@ const (
 var help bool
 var project string
 var metrics []string
+var description string
+var unit string
 var usageTarget = os.Stderr
 var createFn func(context.Context, string) error
 
@@ -44,6 +47,8 @@ func init() {
 		fmt.Sprintf("GCP project name (default: %s environment variable)", projectEnvId))
 	isTimeSeries := flag.Bool("t", false, "Create a time series metric")
 	isCounter := flag.Bool("c", false, "Create a counter metric. Will append '.count' to name")
+	flag.StringVar(&description, "d", "", "Description of the metric (default is derived from the name)")
+	flag.StringVar(&unit, "u", "", "Unit of a counter metric (default: 1)")
 	
 	flag.Parse()
 	if project == "" || len(flag.Args()) == 0 {
@@ -61,7 +66,7 @@ func init() {
 		case kindTimeSeries:	
 			createFn  = func(ctx context.Context, name string) error {
 				fmt.Printf("Creating timer %s\n", name)
-				err :=  stackdriver.Sink.CreateTimeSeries(ctx, name)
+				err := stackdriver.Sink.CreateMetric(ctx, descriptor(name, stats.KindTimer))
 				if err != nil {
 					return err
 				} // Things get weird if you don't send data right away
@@ -74,7 +79,7 @@ func init() {
 		case kindCounter: 
 			createFn  = func(ctx context.Context, name string) error {
 				fmt.Printf("Creating counter %s\n", name)
-				err := stackdriver.Sink.CreateCounter(ctx, name)
+				err := stackdriver.Sink.CreateMetric(ctx, descriptor(name, stats.KindCounter))
 				if err != nil {
 					return err
 				}
@@ -89,6 +94,10 @@ func init() {
 	}
 }
 
+func descriptor(name string, kind stats.Kind) stats.Descriptor {
+	return stats.Descriptor{Name: name, Kind: kind, Description: description, Unit: unit}
+}
+
 func croak(message string) {
 	fmt.Fprintf(usageTarget, "\n*** Error: %s ***\n", message)
 	Usage()
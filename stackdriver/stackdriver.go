@@ -11,6 +11,7 @@ import (
 	"github.com/efixler/multierror"
 	"github.com/efixler/stats"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/monitoring/v3"
 )
 
@@ -21,6 +22,7 @@ const (
 
 var (
 	NoData = errors.New("No data supplied for metric")
+	UnsupportedKind = errors.New("Stackdriver sink does not support this kind of metric")
 )
 
 type sink struct {
@@ -49,24 +51,10 @@ func (s *sink) SetProjectId(pid string) {
 
 // In the Stackdriver implementation, ".count" is always appended to the
 // name of a counter, just to prevent naming clashes with timers.
+// If the counter has been declared in the stats.DefaultRegistry, the declared
+// description and unit are used.
 func (s *sink) CreateCounter(ctx context.Context, name string) error {
-	client, err := getClient(ctx)
-	if err != nil {
-		return err
-	}
-	md := monitoring.MetricDescriptor{
-		Type: fqTypeName(name) + ".count",
-		MetricKind: "CUMULATIVE", //think it should be DELTA but that's not supported for custom
-		ValueType: "INT64",
-		Unit:	"1",
-		Description: name + " counter",
-		DisplayName: "Count of " + name,
-	}
-	_, err = client.Projects.MetricDescriptors.Create(s.ProjectResource(), &md).Do()
-	if err != nil {
-		return err
-	}
-	return nil
+	return s.CreateMetric(ctx, declared(name, stats.KindCounter))
 }
 
 func CreateCounter(ctx context.Context, name string) error {
@@ -76,6 +64,11 @@ func CreateCounter(ctx context.Context, name string) error {
 // If no data is provided here, it is assumed that the caller wants to increment the counter by 1.
 // This method sends the data upstream immediately.
 func (s *sink) IncrementCounter(ctx context.Context, name string, incr ...int) error {
+	return s.incrementCounter(ctx, name, nil, incr...)
+}
+
+// Tags are written as metric labels.
+func (s *sink) incrementCounter(ctx context.Context, name string, tags stats.Tags, incr ...int) error {
 	if len(incr) == 0 {
 		incr = []int{1}
 	}
@@ -88,6 +81,7 @@ func (s *sink) IncrementCounter(ctx context.Context, name string, incr ...int) e
 	}
 	metric := &monitoring.Metric{
 		Type: fqTypeName(name) + ".count", //todo: check for .count in name, don't double up
+		Labels: tags,
 	}
 	resource := &monitoring.MonitoredResource{
 		Type: "global",
@@ -116,14 +110,101 @@ func (s *sink) IncrementCounter(ctx context.Context, name string, incr ...int) e
 		return err
 	}
 	_, err = client.Projects.TimeSeries.Create(s.ProjectResource(), &r).Do()
+	return classify(err)
+}
+
+func IncrementCounter(ctx context.Context, name string, incr ...int) error {
+	return Sink.IncrementCounter(ctx, name, incr...)
+}
+
+// Create the Stackdriver metric descriptor for a declared metric. Counters, timers
+// and gauges are supported. Timers are always written in milliseconds, so the unit of a timer
+// descriptor is ignored.
+func (s *sink) CreateMetric(ctx context.Context, d stats.Descriptor) error {
+	var md *monitoring.MetricDescriptor
+	switch d.Kind {
+	case stats.KindCounter:
+		md = &monitoring.MetricDescriptor{
+			Type:        fqTypeName(d.Name) + ".count",
+			MetricKind:  "CUMULATIVE", //think it should be DELTA but that's not supported for custom
+			ValueType:   "INT64",
+			Unit:        d.Unit,
+			Description: d.Description,
+			DisplayName: "Count of " + d.Name,
+		}
+		if md.Description == "" {
+			md.Description = d.Name + " counter"
+		}
+	case stats.KindTimer:
+		md = &monitoring.MetricDescriptor{
+			Type:        fqTypeName(d.Name),
+			MetricKind:  "GAUGE",
+			ValueType:   "INT64",
+			Unit:        "ms",
+			Description: d.Description,
+			DisplayName: d.Name + " time in milliseconds",
+		}
+		if md.Description == "" {
+			md.Description = d.Name + " time series"
+		}
+	case stats.KindGauge:
+		md = &monitoring.MetricDescriptor{
+			Type:        fqTypeName(d.Name),
+			MetricKind:  "GAUGE",
+			ValueType:   "INT64",
+			Unit:        d.Unit,
+			Description: d.Description,
+			DisplayName: d.Name,
+		}
+		if md.Description == "" {
+			md.Description = d.Name + " gauge"
+		}
+	default:
+		return UnsupportedKind
+	}
+	if md.Unit == "" {
+		md.Unit = d.Kind.DefaultUnit()
+	}
+	for _, tag := range d.Tags {
+		md.Labels = append(md.Labels, &monitoring.LabelDescriptor{Key: tag, ValueType: "STRING"})
+	}
+	client, err := getClient(ctx)
 	if err != nil {
 		return err
 	}
-	return nil
+	_, err = client.Projects.MetricDescriptors.Create(s.ProjectResource(), md).Do()
+	return err
 }
 
-func IncrementCounter(ctx context.Context, name string, incr ...int) error {
-	return Sink.IncrementCounter(ctx, name, incr...)
+func CreateMetric(ctx context.Context, d stats.Descriptor) error {
+	return Sink.CreateMetric(ctx, d)
+}
+
+// Create Stackdriver descriptors for all of the counters, timers and gauges declared
+// in reg. Metrics of other kinds are skipped.
+func (s *sink) Provision(ctx context.Context, reg *stats.Registry) error {
+	me := make(multierror.MultiError, 0)
+	for _, d := range reg.Descriptors() {
+		if d.Kind == stats.KindHistogram {
+			continue
+		}
+		if err := s.CreateMetric(ctx, d); err != nil {
+			me = append(me, err)
+		}
+	}
+	return me.NilWhenEmpty()
+}
+
+func Provision(ctx context.Context, reg *stats.Registry) error {
+	return Sink.Provision(ctx, reg)
+}
+
+// declared returns the registered descriptor for name, or a bare one of the given kind
+func declared(name string, kind stats.Kind) stats.Descriptor {
+	if d, ok := stats.DefaultRegistry.Lookup(name); ok && d.Kind == kind {
+		return d
+	}
+	return stats.Descriptor{Name: name, Kind: kind}
 }
 
 func (s *sink) timeWindowBounds() (time.Time, time.Time) {
@@ -134,24 +215,10 @@ func (s *sink) timeWindowBounds() (time.Time, time.Time) {
 	return time.Unix(tStart, 0).UTC(), time.Unix(tEnd, 0).UTC()
 }
 
+// If the timer has been declared in the stats.DefaultRegistry, the declared
+// description is used.
 func (s *sink) CreateTimeSeries(ctx context.Context, name string) error {
-	client, err := getClient(ctx)
-	if err != nil {
-		return err
-	}
-	md := monitoring.MetricDescriptor{
-		Type: fqTypeName(name),
-		MetricKind: "GAUGE",
-		ValueType: "INT64",
-		Unit:	"ms",
-		Description: name + " time series",
-		DisplayName: name + " time in milliseconds",
-	}
-	_, err = client.Projects.MetricDescriptors.Create(s.ProjectResource(), &md).Do()
-	if err != nil {
-		return err
-	}
-	return nil
+	return s.CreateMetric(ctx, declared(name, stats.KindTimer))
 }
 
 func CreateTimeSeries(ctx context.Context, name string) error {
@@ -164,11 +231,17 @@ func CreateTimeSeries(ctx context.Context, name string) error {
 // If no durations are passed, the method returns a NoData error. Any other errors returned
 // indicate a Stackdriver API/service issue.
 func (s *sink) WriteTimeSeries(ctx context.Context, name string, durationsMs ...int) error {
+	return s.writeTimeSeries(ctx, name, nil, durationsMs...)
+}
+
+// Tags are written as metric labels.
+func (s *sink) writeTimeSeries(ctx context.Context, name string, tags stats.Tags, durationsMs ...int) error {
 	if len(durationsMs) == 0 {
 		return NoData
 	}
 	metric := &monitoring.Metric{
 		Type: fqTypeName(name),
+		Labels: tags,
 	}
 	resource := &monitoring.MonitoredResource{
 		Type: "global",
@@ -210,10 +283,7 @@ func (s *sink) WriteTimeSeries(ctx context.Context, name string, durationsMs ...
 		return err
 	}
 	_, err = client.Projects.TimeSeries.Create(s.ProjectResource(), &r).Do()
-	if err != nil {
-		return err
-	}
-	return nil
+	return classify(err)
 }
 
 func WriteTimeSeries(ctx context.Context, name string, durationsMs ...int) error {
@@ -221,6 +291,16 @@ func WriteTimeSeries(ctx context.Context, name string, durationsMs ...int) error
 }
 
 
+// classify marks API errors as retryable or not, for stats.RetrySink. Errors
+// other than API errors are left for stats.IsRetryable to judge.
+func classify(err error) error {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return stats.MarkRetryable(err, stats.RetryableStatus(apiErr.Code))
+	}
+	return err
+}
+
 func fqTypeName(shortName string) string {
 	if strings.Index(shortName, typeNamePrefix) == 0 {
 		return shortName
@@ -240,12 +320,15 @@ func getClient(ctx context.Context) (*monitoring.Service, error) {
 	return s, nil
 }
 
-// Write all of the supplied counters to the data store. Implements the Sink interface 
+// Write all of the supplied counters to the data store. Implements the Sink interface.
+// Sampled counters are written as their estimates.
+// Each failure is returned as a stats.MetricError, so that stats.RetrySink can retry
+// just the metrics that failed.
 func (ss *sink) WriteCounters(ctx context.Context, counters ...*stats.Counter) error {
 	me := make(multierror.MultiError,0)
 	for _, counter := range counters {
-		if err := IncrementCounter(ctx, counter.Name(), counter.Data()); err != nil {
-			me = append(me, err)
+		if err := ss.incrementCounter(ctx, counter.Name(), counter.Tags(), counter.Estimate()); err != nil {
+			me = append(me, &stats.MetricError{Metric: counter, Err: err})
 		}
 	}
 	if len(me) != 0 {
@@ -258,8 +341,23 @@ func (ss *sink) WriteCounters(ctx context.Context, counters ...*stats.Counter) e
 func (ss *sink) WriteTimers(ctx context.Context, timers ...*stats.Timer) error {
 	me := make(multierror.MultiError,0)
 	for _, timer := range timers {
-		if err := WriteTimeSeries(ctx, timer.Name(), timer.Milliseconds()); err != nil {
-			me = append(me, err)
+		if err := ss.writeTimeSeries(ctx, timer.Name(), timer.Tags(), timer.Milliseconds()); err != nil {
+			me = append(me, &stats.MetricError{Metric: timer, Err: err})
+		}
+	}
+	if len(me) != 0 {
+		return me
+	}
+	return nil
+}
+
+// Write all of the supplied gauges to the data store, as INT64 gauge points.
+// Implements stats.GaugeWriter.
+func (ss *sink) WriteGauges(ctx context.Context, gauges ...*stats.Gauge) error {
+	me := make(multierror.MultiError,0)
+	for _, gauge := range gauges {
+		if err := ss.writeTimeSeries(ctx, gauge.Name(), gauge.Tags(), gauge.Value()); err != nil {
+			me = append(me, &stats.MetricError{Metric: gauge, Err: err})
 		}
 	}
 	if len(me) != 0 {
@@ -268,6 +366,11 @@ func (ss *sink) WriteTimers(ctx context.Context, timers ...*stats.Timer) error {
 	return nil
 }
 
+// Stackdriver metric types are paths, so names are passed through stats.StackdriverNames.
+// Implements stats.NameTranslator.
+func (s *sink) TranslateName(name string) string {
+	return stats.StackdriverNames.TranslateName(name)
+}
 
 func (s *sink) DeleteMetric(ctx context.Context, name string) error {
 	fqn := s.ProjectResource() + "/metricDescriptors/custom.googleapis.com/" + name  
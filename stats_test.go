@@ -17,6 +17,24 @@ func TestMetricsInitted(t *testing.T) {
 	}
 }
 
+func TestFromContext(t *testing.T) {
+	if r := FromContext(context.Background()); r != NopRecorder {
+		t.Errorf("Expected NopRecorder for uninitialized context, got %T", r)
+	}
+	ctx := requestContextUsingMetrics()
+	r := FromContext(ctx)
+	if err := r.Increment("my/test/metric"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	rs, _ := statsFromContext(ctx)
+	if c := rs.counters["my/test/metric"]; c == nil || c.Data() != 1 {
+		t.Errorf("Recorder increment not reflected in request stats: %v", c)
+	}
+	if err := r.FinishTimer("never_started"); err != TimerNotStarted {
+		t.Errorf("Expected error %s, got %v", TimerNotStarted, err)
+	}
+}
+
 var nameChecks = []struct {
 	name string
 	err  error
@@ -45,3 +63,13 @@ func requestContextUsingMetrics() context.Context {
 	ctx = statsToContext(ctx, newRequestStats())
 	return ctx
 }
+
+// statsFromContext gets at the request's metrics without locking them, for tests that
+// look inside while nothing else is running
+func statsFromContext(ctx context.Context) (*requestStats, bool) {
+	rs, ok := lockStats(ctx)
+	if ok {
+		rs.mu.Unlock()
+	}
+	return rs, ok
+}
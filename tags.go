@@ -0,0 +1,54 @@
+package stats
+
+import (
+	"sort"
+	"strings"
+)
+
+// Tags are key/value labels on a metric. Metrics recorded in a request don't have
+// tags of their own; tags are added on the way to the Sink, by the decorators in
+// this package or by your own. Treat the Tags on a metric as read-only: decorators
+// that change tags work on copies of the metric.
+type Tags map[string]string
+
+// String is a canonical form of the tags, with keys sorted, e.g. "method=get,route=users".
+func (t Tags) String() string {
+	if len(t) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(t[k])
+	}
+	return b.String()
+}
+
+// With returns a copy of t with the supplied tags merged in. t is not modified.
+func (t Tags) With(more Tags) Tags {
+	merged := make(Tags, len(t)+len(more))
+	for k, v := range t {
+		merged[k] = v
+	}
+	for k, v := range more {
+		merged[k] = v
+	}
+	return merged
+}
+
+// seriesKey identifies a time series: a metric name along with a particular set of tag values
+func seriesKey(name string, tags Tags) string {
+	if len(tags) == 0 {
+		return name
+	}
+	return name + "{" + tags.String() + "}"
+}